@@ -0,0 +1,80 @@
+package entities
+
+import (
+	"go-galtonboard/utils"
+	"math"
+)
+
+// AssignPhases sets the phase of every displaced peg. The wave modes take it from the
+// row and column of the peg, the random modes draw it from the given generator.
+func AssignPhases(pegs []*Particle, pegConfig utils.PegConfig, boardConfig utils.BoardConfig, random *utils.Random) {
+	offset := 0.0
+	if boardConfig.Bins.Enabled {
+		offset = boardConfig.Bins.WallHeight
+	}
+
+	for _, peg := range pegs {
+		displacement := &pegConfig.Displacement
+		if peg.Displacement != nil {
+			displacement = peg.Displacement
+		}
+
+		if !displacement.Displacement {
+			continue
+		}
+
+		switch displacement.Mode {
+		case utils.DisplacementTravelingWave, utils.DisplacementStandingWave:
+			row := (peg.Position[1] - offset) / boardConfig.VerticalSpace
+			column := peg.Position[0] / boardConfig.HorizontalSpace
+			peg.Phase = displacement.PhaseRow*row + displacement.PhaseColumn*column
+
+		case utils.DisplacementRandomPhase:
+			peg.Phase = 2 * math.Pi * random.Float64()
+
+		case utils.DisplacementNoise:
+			// One phase per mode and direction
+			peg.NoisePhases = make([]float64, 2*displacement.NModes)
+			for i := range peg.NoisePhases {
+				peg.NoisePhases[i] = 2 * math.Pi * random.Float64()
+			}
+		}
+	}
+}
+
+// AssignBreathing sets the base radius, the envelope, the phase and the initial radius
+// of every peg when the pegs breathe. The envelope is the profile of the Envelope
+// distribution scaled between 0 and 1, or 1 everywhere for the uniform one.
+func AssignBreathing(pegs []*Particle, pegConfig utils.PegConfig, boardConfig utils.BoardConfig) {
+	breathing := pegConfig.Breathing
+	if !breathing.Enabled {
+		return
+	}
+
+	offset := 0.0
+	if boardConfig.Bins.Enabled {
+		offset = boardConfig.Bins.WallHeight
+	}
+
+	envelopeConfig := pegConfig
+	envelopeConfig.Distribution = breathing.Envelope
+	spread := pegConfig.MaxRadius - pegConfig.MinRadius
+
+	for _, peg := range pegs {
+		x := peg.Position[0]
+		y := peg.Position[1] - offset
+
+		peg.BaseRadius = peg.Radius
+		peg.Envelope = 1
+		if breathing.Envelope != utils.PegUniformDist && spread > 0 {
+			peg.Envelope = (getRadius(&envelopeConfig, &boardConfig, y, x) - pegConfig.MinRadius) / spread
+		}
+
+		row := y / boardConfig.VerticalSpace
+		column := x / boardConfig.HorizontalSpace
+		peg.BreathingPhase = breathing.PhaseRow*row + breathing.PhaseColumn*column
+
+		// The radius starts at its t=0 value, so the first BreathePeg sees no jump
+		peg.Radius = math.Max(peg.BaseRadius+breathing.Amplitude*peg.Envelope*math.Sin(peg.BreathingPhase), 0)
+	}
+}
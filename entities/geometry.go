@@ -0,0 +1,145 @@
+package entities
+
+import (
+	"errors"
+	"go-galtonboard/utils"
+	"math"
+)
+
+// Segment represents a static line obstacle. Its Damping multiplies the restitution
+// of the balls hitting it. A one sided segment only lets the
+// balls stay on its left, looking from A to B, and pushes back any ball behind it.
+type Segment struct {
+	A        utils.Point
+	B        utils.Point
+	Damping  float64
+	OneSided bool
+}
+
+// Polygon represents a static convex obstacle with its vertices in counter-clockwise
+// order. Its Damping multiplies the restitution of the balls hitting it.
+type Polygon struct {
+	Vertices []utils.Point
+	Damping  float64
+}
+
+// Bounds returns the corners of the bounding box of the segment
+func (s *Segment) Bounds() (utils.Point, utils.Point) {
+	return utils.Point{math.Min(s.A[0], s.B[0]), math.Min(s.A[1], s.B[1])},
+		utils.Point{math.Max(s.A[0], s.B[0]), math.Max(s.A[1], s.B[1])}
+}
+
+// Bounds returns the corners of the bounding box of the polygon
+func (p *Polygon) Bounds() (utils.Point, utils.Point) {
+	min := p.Vertices[0]
+	max := p.Vertices[0]
+	for _, v := range p.Vertices[1:] {
+		min = utils.Point{math.Min(min[0], v[0]), math.Min(min[1], v[1])}
+		max = utils.Point{math.Max(max[0], v[0]), math.Max(max[1], v[1])}
+	}
+
+	return min, max
+}
+
+// NewPolygon returns a convex polygon with the given vertices, in either orientation.
+func NewPolygon(vertices []utils.Point, damping float64) (*Polygon, error) {
+	if len(vertices) < 3 {
+		return nil, errors.New("a polygon needs at least three vertices")
+	}
+
+	area := 0.0
+	for i := range vertices {
+		a := vertices[i]
+		b := vertices[(i+1)%len(vertices)]
+		area += a[0]*b[1] - b[0]*a[1]
+	}
+
+	ordered := make([]utils.Point, len(vertices))
+	copy(ordered, vertices)
+	if area < 0 {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+
+	// Every turn of a convex counter-clockwise polygon goes to the left
+	n := len(ordered)
+	for i := range ordered {
+		a := ordered[i]
+		b := ordered[(i+1)%n]
+		c := ordered[(i+2)%n]
+		cross := (b[0]-a[0])*(c[1]-b[1]) - (b[1]-a[1])*(c[0]-b[0])
+		if cross < 0 {
+			return nil, errors.New("polygon obstacles must be convex")
+		}
+	}
+
+	return &Polygon{Vertices: ordered, Damping: damping}, nil
+}
+
+// NewObstacles returns the static geometry of the board: the obstacles listed in
+// the configuration, the walls of the collection tray and, for solid borders, the
+// border of the board as one sided segments facing inwards.
+func NewObstacles(boardConfig utils.BoardConfig, border []*utils.Point) ([]*Segment, []*Polygon, error) {
+	segments := make([]*Segment, 0)
+	polygons := make([]*Polygon, 0)
+
+	for _, obstacle := range boardConfig.Obstacles {
+		points := make([]utils.Point, len(obstacle.Points))
+		for i, point := range obstacle.Points {
+			points[i] = point
+		}
+
+		switch obstacle.Type {
+		case utils.ObstacleSegment:
+			if len(points) < 2 {
+				return nil, nil, errors.New("a segment obstacle needs at least two points")
+			}
+
+			// Consecutive points form a polyline
+			for i := 0; i+1 < len(points); i++ {
+				segments = append(segments, &Segment{A: points[i], B: points[i+1], Damping: obstacle.Damping, OneSided: obstacle.OneSided})
+			}
+
+		case utils.ObstaclePolygon:
+			polygon, err := NewPolygon(points, obstacle.Damping)
+			if err != nil {
+				return nil, nil, err
+			}
+			polygons = append(polygons, polygon)
+
+		default:
+			return nil, nil, errors.New("invalid obstacle type, valid values are 0 (segment) and 1 (polygon)")
+		}
+	}
+
+	bins := boardConfig.Bins
+	if bins.Enabled {
+		for j := 1; j < boardConfig.NCols-1; j++ {
+			x := float64(j) * boardConfig.HorizontalSpace
+			polygons = append(polygons, &Polygon{
+				Vertices: []utils.Point{
+					{x - bins.WallWidth/2, 0},
+					{x + bins.WallWidth/2, 0},
+					{x + bins.WallWidth/2, bins.WallHeight},
+					{x - bins.WallWidth/2, bins.WallHeight},
+				},
+				Damping: bins.Damping,
+			})
+		}
+	}
+
+	if boardConfig.SolidBorder {
+		// The release point border[0] sits on the top edge, so the roof is flat
+		segments = append(segments, &Segment{A: *border[1], B: *border[4], Damping: 1, OneSided: true})
+
+		if !boardConfig.Periodic {
+			segments = append(segments,
+				&Segment{A: *border[2], B: *border[1], Damping: 1, OneSided: true},
+				&Segment{A: *border[4], B: *border[3], Damping: 1, OneSided: true},
+			)
+		}
+	}
+
+	return segments, polygons, nil
+}
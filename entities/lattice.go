@@ -0,0 +1,184 @@
+package entities
+
+import (
+	"go-galtonboard/utils"
+	"log"
+	"math"
+)
+
+// poissonDiskAttempts is the number of candidates tried around every active sample
+// before it is retired.
+const poissonDiskAttempts = 30
+
+// latticeSites returns the peg centers of the configured lattice, inside a box of the
+// given width and height starting at the origin.
+func latticeSites(boardConfig *utils.BoardConfig, width, height float64, random *utils.Random) []utils.Point {
+	switch boardConfig.Lattice {
+	case utils.LatticeStaggered:
+		return staggeredSites(boardConfig)
+
+	case utils.LatticeSquare:
+		return obliqueSites(boardConfig, width, 0, false)
+
+	case utils.LatticeTriangular:
+		return obliqueSites(boardConfig, width, rowShift(boardConfig), false)
+
+	case utils.LatticeHoneycomb:
+		return obliqueSites(boardConfig, width, rowShift(boardConfig), true)
+
+	case utils.LatticeRandom:
+		sites := make([]utils.Point, boardConfig.NRows*boardConfig.NCols)
+		for i := range sites {
+			sites[i] = utils.Point{random.Float64() * width, random.Float64() * height}
+		}
+		return sites
+
+	case utils.LatticePoissonDisk:
+		return poissonDiskSites(width, height, boardConfig.MinSeparation, random)
+
+	default:
+		log.Fatal("Invalid lattice in the config file. Valid values are: \n" +
+			"\t0: Staggered lattice\n" +
+			"\t1: Square lattice\n" +
+			"\t2: Triangular lattice\n" +
+			"\t3: Honeycomb lattice\n" +
+			"\t4: Uniform random\n" +
+			"\t5: Poisson-disk sampling")
+	}
+
+	return nil
+}
+
+// staggeredSites shifts the odd rows by half a column, dropping their last peg.
+func staggeredSites(boardConfig *utils.BoardConfig) []utils.Point {
+	sites := make([]utils.Point, 0, boardConfig.NRows*boardConfig.NCols)
+
+	for i := 0; i < boardConfig.NRows; i++ {
+		for j := 0; j < boardConfig.NCols; j++ {
+			x := float64(j) * (boardConfig.HorizontalSpace)
+			y := float64(i) * (boardConfig.VerticalSpace)
+			if i%2 != 0 {
+				x += (boardConfig.HorizontalSpace) / 2
+
+				if j == boardConfig.NCols-1 {
+					continue
+				}
+			}
+
+			sites = append(sites, utils.Point{x, y})
+		}
+	}
+
+	return sites
+}
+
+// rowShift returns the horizontal shift between two rows for the lattice angle.
+func rowShift(boardConfig *utils.BoardConfig) float64 {
+	angle := boardConfig.LatticeAngle * math.Pi / 180
+	if angle <= 0 || angle >= math.Pi {
+		log.Fatal("Invalid lattice angle in the config file, it must be between 0 and 180 degrees")
+	}
+
+	return boardConfig.VerticalSpace / math.Tan(angle)
+}
+
+// obliqueSites returns the lattice spanned by (HorizontalSpace, 0) and
+// (shift, VerticalSpace). The honeycomb removes one site out of three, the
+// sites of the coarser triangular lattice where (m - n) mod 3 == 0.
+func obliqueSites(boardConfig *utils.BoardConfig, width, shift float64, honeycomb bool) []utils.Point {
+	sites := make([]utils.Point, 0, boardConfig.NRows*boardConfig.NCols)
+	epsilon := 1e-9 * boardConfig.HorizontalSpace
+
+	for n := 0; n < boardConfig.NRows; n++ {
+		y := float64(n) * boardConfig.VerticalSpace
+		offset := float64(n) * shift
+
+		first := int(math.Ceil((-offset - epsilon) / boardConfig.HorizontalSpace))
+		last := int(math.Floor((width - offset + epsilon) / boardConfig.HorizontalSpace))
+		for m := first; m <= last; m++ {
+			if honeycomb && ((m-n)%3+3)%3 == 0 {
+				continue
+			}
+
+			x := float64(m)*boardConfig.HorizontalSpace + offset
+			sites = append(sites, utils.Point{x, y})
+		}
+	}
+
+	return sites
+}
+
+// poissonDiskSites fills the box with samples at least minSeparation apart, using
+// Bridson's algorithm.
+func poissonDiskSites(width, height, minSeparation float64, random *utils.Random) []utils.Point {
+	if minSeparation <= 0 {
+		log.Fatal("Invalid minimum separation in the config file, it must be positive")
+	}
+
+	// Every cell of the background grid holds at most one sample
+	cellSize := minSeparation / math.Sqrt2
+	columns := int(math.Ceil(width/cellSize)) + 1
+	rows := int(math.Ceil(height/cellSize)) + 1
+	grid := make([]int, columns*rows)
+	for i := range grid {
+		grid[i] = -1
+	}
+
+	sites := make([]utils.Point, 0)
+	active := make([]int, 0)
+
+	add := func(p utils.Point) {
+		grid[int(p[1]/cellSize)*columns+int(p[0]/cellSize)] = len(sites)
+		active = append(active, len(sites))
+		sites = append(sites, p)
+	}
+
+	fits := func(p utils.Point) bool {
+		if p[0] < 0 || p[0] > width || p[1] < 0 || p[1] > height {
+			return false
+		}
+
+		row := int(p[1] / cellSize)
+		column := int(p[0] / cellSize)
+		for i := row - 2; i <= row+2; i++ {
+			for j := column - 2; j <= column+2; j++ {
+				if i < 0 || i >= rows || j < 0 || j >= columns || grid[i*columns+j] < 0 {
+					continue
+				}
+
+				other := sites[grid[i*columns+j]]
+				if math.Hypot(p[0]-other[0], p[1]-other[1]) < minSeparation {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	add(utils.Point{random.Float64() * width, random.Float64() * height})
+
+	for len(active) > 0 {
+		k := random.IntN(len(active))
+		center := sites[active[k]]
+
+		found := false
+		for attempt := 0; attempt < poissonDiskAttempts; attempt++ {
+			angle := 2 * math.Pi * random.Float64()
+			distance := minSeparation * (1 + random.Float64())
+			candidate := utils.Point{center[0] + distance*math.Cos(angle), center[1] + distance*math.Sin(angle)}
+			if fits(candidate) {
+				add(candidate)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			active[k] = active[len(active)-1]
+			active = active[:len(active)-1]
+		}
+	}
+
+	return sites
+}
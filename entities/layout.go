@@ -0,0 +1,181 @@
+package entities
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-galtonboard/utils"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PegRecord represents a single peg of a geometry file. Damping falls back to the
+// peg configuration when it is missing, and Displacement replaces the global one.
+type PegRecord struct {
+	X            float64
+	Y            float64
+	Radius       float64
+	Damping      *float64
+	Displacement *utils.PegDisplacement
+}
+
+// LoadPegs returns the pegs and the border of a board read from a geometry file. The
+// layout is shifted so the bounding box of the pegs, radii included, starts at the
+// origin, with the collection tray below it when enabled. The schedules of the pegs
+// with their own displacement are read relative to the given route.
+func LoadPegs(fileName, route string, pegConfig utils.PegConfig, boardConfig utils.BoardConfig) ([]*Particle, []*utils.Point, error) {
+	var (
+		records []PegRecord
+		err     error
+	)
+
+	if strings.HasSuffix(strings.ToLower(fileName), ".csv") {
+		records, err = readPegsCsv(fileName)
+	} else {
+		records, err = readPegsJson(fileName)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil, errors.New("the geometry file has no pegs")
+	}
+
+	offset := 0.0
+	if boardConfig.Bins.Enabled {
+		offset = boardConfig.Bins.WallHeight
+	}
+
+	min := utils.Point{math.Inf(1), math.Inf(1)}
+	max := utils.Point{math.Inf(-1), math.Inf(-1)}
+	for i, record := range records {
+		if record.Radius <= 0 {
+			return nil, nil, errors.New("every peg of the geometry file needs a positive radius")
+		}
+
+		displacement := record.Displacement
+		if displacement != nil && displacement.Displacement && displacement.Mode == utils.DisplacementSchedule {
+			err = displacement.LoadSchedule(route)
+			if err != nil {
+				return nil, nil, fmt.Errorf("peg %d of the geometry file: %v", i, err)
+			}
+		}
+
+		// The box holds the whole pegs, so the edge pegs stay clear of the walls
+		min = utils.Point{math.Min(min[0], record.X-record.Radius), math.Min(min[1], record.Y-record.Radius)}
+		max = utils.Point{math.Max(max[0], record.X+record.Radius), math.Max(max[1], record.Y+record.Radius)}
+	}
+
+	pegs := make([]*Particle, 0, len(records))
+	for _, record := range records {
+		peg := NewPeg(utils.Point{record.X - min[0], record.Y - min[1] + offset})
+		peg.Radius = record.Radius
+		peg.Damping = pegConfig.Damping
+		if record.Damping != nil {
+			peg.Damping = *record.Damping
+		}
+		peg.Friction = pegConfig.Friction
+		peg.Displacement = record.Displacement
+		pegs = append(pegs, peg)
+	}
+
+	width := max[0] - min[0]
+	height := max[1] - min[1] + boardConfig.StartHeightParticle + offset
+
+	border := make([]*utils.Point, 5)
+	border[0] = &utils.Point{width / 2, height}
+	border[1] = &utils.Point{width, height}
+	border[2] = &utils.Point{width, 0}
+	border[3] = &utils.Point{0, 0}
+	border[4] = &utils.Point{0, height}
+
+	return pegs, border, nil
+}
+
+// readPegsJson reads a list of peg records.
+func readPegsJson(fileName string) ([]PegRecord, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.New("error opening the geometry file")
+	}
+	defer file.Close()
+
+	records := make([]PegRecord, 0)
+	err = json.NewDecoder(file).Decode(&records)
+	if err != nil {
+		return nil, errors.New("error decoding the geometry file")
+	}
+
+	return records, nil
+}
+
+// readPegsCsv reads one peg per line as x, y, radius and, optionally, damping and the
+// displacement amplitudes and frequencies. Comments and a header line are skipped.
+func readPegsCsv(fileName string) ([]PegRecord, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.New("error opening the geometry file")
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records := make([]PegRecord, 0)
+	for row := 0; ; row++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("error reading the geometry file")
+		}
+
+		// The row counts records, the line skips the comments too
+		line, _ := reader.FieldPos(0)
+
+		values := make([]float64, len(fields))
+		for i, field := range fields {
+			values[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			if row == 0 {
+				continue
+			}
+			return nil, errors.New("invalid number in the geometry file at line " + strconv.Itoa(line))
+		}
+
+		if len(values) != 3 && len(values) != 4 && len(values) != 8 {
+			return nil, errors.New("the geometry file needs 3, 4 or 8 columns at line " + strconv.Itoa(line))
+		}
+
+		record := PegRecord{X: values[0], Y: values[1], Radius: values[2]}
+		if len(values) > 3 {
+			record.Damping = &values[3]
+		}
+		if len(values) == 8 {
+			record.Displacement = &utils.PegDisplacement{
+				Displacement: true,
+				AmplitudeX:   values[4],
+				AmplitudeY:   values[5],
+				FrequencyX:   values[6],
+				FrequencyY:   values[7],
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
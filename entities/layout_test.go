@@ -0,0 +1,52 @@
+package entities
+
+import (
+	"go-galtonboard/utils"
+	"os"
+	"testing"
+)
+
+func TestLoadPegsSchedule(t *testing.T) {
+	route := t.TempDir() + "/"
+	layout := `[
+		{"X": 0, "Y": 0, "Radius": 2},
+		{"X": 20, "Y": 0, "Radius": 2, "Displacement": {"Displacement": true, "Mode": 5, "ScheduleFile": "peg.csv"}}
+	]`
+
+	err := os.WriteFile(route+"layout.json", []byte(layout), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = LoadPegs(route+"layout.json", route, utils.PegConfig{}, utils.BoardConfig{})
+	if err == nil || err.Error() != "peg 1 of the geometry file: error opening the schedule file" {
+		t.Errorf("missing schedule: got error %v", err)
+	}
+
+	err = os.WriteFile(route+"peg.csv", []byte("t, dx, dy\n0, 0, 0\n1, 3, 4\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pegs, _, err := LoadPegs(route+"layout.json", route, utils.PegConfig{}, utils.BoardConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pegs[0].Displacement != nil {
+		t.Errorf("got displacement %v for the peg without one", pegs[0].Displacement)
+	}
+
+	schedule := pegs[1].Displacement.Schedule()
+	if schedule == nil {
+		t.Fatal("the schedule of the peg was not loaded")
+	}
+
+	if x, y := schedule.At(0.5, false); x != 1.5 || y != 2 {
+		t.Errorf("got displacement (%v, %v) at t=0.5, want (1.5, 2)", x, y)
+	}
+
+	if reach := pegs[1].Displacement.Reach(); reach != 5 {
+		t.Errorf("got reach %v, want 5", reach)
+	}
+}
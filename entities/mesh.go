@@ -1,14 +1,19 @@
 package entities
 
 import (
+	"fmt"
 	"go-galtonboard/utils"
-	"log"
 	"math"
 )
 
+// Cell holds the bodies of a mesh cell. ParticlesIds are the moving balls, PileIds the
+// balls at rest in the collection tray, which never move again.
 type Cell struct {
 	ParticlesIds []int
+	PileIds      []int
 	PegsIds      []int
+	SegmentsIds  []int
+	PolygonsIds  []int
 }
 
 type Mesh struct {
@@ -19,73 +24,206 @@ type Mesh struct {
 	dWidth  float64
 	dHeight float64
 	Cells   []Cell
+
+	// Cell of every ball moved with MoveParticle, -1 when it is not in the mesh
+	particleCells []int
+	// Cell of every ball added to a pile, -1 when it is not in a pile
+	pileCells []int
 }
 
-func NewMesh(rows, columns int, width, height float64) *Mesh {
+// NewMesh splits the box [0, width] x [0, height] in square-ish cells no smaller than
+// cellSize, so everything touching a ball lies in its cell or in the eight around it.
+func NewMesh(width, height, cellSize float64) *Mesh {
+	rows := int(math.Max(math.Floor(height/cellSize), 1))
+	columns := int(math.Max(math.Floor(width/cellSize), 1))
+
 	mesh := Mesh{
 		Rows:    rows,
 		Columns: columns,
 		Cells:   make([]Cell, columns*rows),
 		Width:   width,
 		Height:  height,
-		dWidth:  width / float64(columns),
-		dHeight: height / float64(rows),
+		dWidth:  math.Max(width/float64(columns), cellSize),
+		dHeight: math.Max(height/float64(rows), cellSize),
 	}
 
 	return &mesh
 }
 
-func (m *Mesh) AddParticleToCell(x, y float64, particleType int, particleId int) {
-	row := int(math.Ceil(y / m.dHeight))
-	column := int(math.Ceil(x / m.dWidth))
+// CellCoordinates returns the row and column of the cell containing the given position.
+// Positions less than a cell outside the mesh belong to the border cells, which is
+// where the walls push them back from.
+func (m *Mesh) CellCoordinates(x, y float64) (int, int) {
+	row := int(math.Floor(y / m.dHeight))
+	column := int(math.Floor(x / m.dWidth))
 
-	if row >= m.Rows {
+	if row == -1 {
+		row = 0
+	} else if row == m.Rows {
 		row = m.Rows - 1
 	}
 
-	if column >= m.Columns {
+	if column == -1 {
+		column = 0
+	} else if column == m.Columns {
 		column = m.Columns - 1
 	}
 
-	cellIndex := column*m.Rows + row
-	if cellIndex >= len(m.Cells) || cellIndex < 0 {
-		log.Fatal("AddParticleToCell: cellIndex out of bounds. Particle position: (", x, y, ") Row: ", row, " Column: ", column)
+	return row, column
+}
+
+// CellIndex returns the index in Cells of the cell containing the given position.
+func (m *Mesh) CellIndex(x, y float64) (int, error) {
+	row, column := m.CellCoordinates(x, y)
+	if row < 0 || row >= m.Rows || column < 0 || column >= m.Columns {
+		return 0, fmt.Errorf("position (%g, %g) is outside the mesh of %g x %g", x, y, m.Width, m.Height)
+	}
+
+	return column*m.Rows + row, nil
+}
+
+// ClampedCellIndex returns the index in Cells of the cell containing the given position,
+// moving the positions outside the mesh to the nearest border cell. The balls use it,
+// since the top and the sides of the board are open.
+func (m *Mesh) ClampedCellIndex(x, y float64) int {
+	row, column := m.CellCoordinates(x, y)
+	return clampIndex(column, m.Columns)*m.Rows + clampIndex(row, m.Rows)
+}
+
+// CellSize returns the width and height of a single cell.
+func (m *Mesh) CellSize() (float64, float64) {
+	return m.dWidth, m.dHeight
+}
+
+func (m *Mesh) AddParticleToCell(x, y float64, particleType int, particleId int) error {
+	cellIndex, err := m.CellIndex(x, y)
+	if err != nil {
+		return err
 	}
+
 	if particleType == utils.Peg {
 		m.Cells[cellIndex].PegsIds = append(m.Cells[cellIndex].PegsIds, particleId)
 	} else {
-		m.Cells[cellIndex].ParticlesIds = append(m.Cells[cellIndex].ParticlesIds, particleId)
+		m.MoveParticle(particleId, cellIndex)
 	}
+
+	return nil
 }
 
-func (m *Mesh) ClearMesh() {
-	for i := 0; i < m.Rows; i++ {
-		for j := 0; j < m.Columns; j++ {
-			m.Cells[j*m.Rows+i].ParticlesIds = nil
+// AddObstacleToCells registers a static obstacle in every cell overlapping its
+// bounding box grown by the margin, so a ball only needs to check its own cell.
+func (m *Mesh) AddObstacleToCells(min, max utils.Point, margin float64, obstacleType int, obstacleId int) {
+	rowStart, columnStart, rowEnd, columnEnd := m.CellRange(min, max, margin)
+
+	for i := rowStart; i <= rowEnd; i++ {
+		for j := columnStart; j <= columnEnd; j++ {
+			cell := &m.Cells[j*m.Rows+i]
+			if obstacleType == utils.ObstacleSegment {
+				cell.SegmentsIds = append(cell.SegmentsIds, obstacleId)
+			} else {
+				cell.PolygonsIds = append(cell.PolygonsIds, obstacleId)
+			}
 		}
 	}
 }
 
-func (m *Mesh) GetCell(row, column int) *Cell {
-	if row < 0 || row >= m.Rows || column < 0 || column >= m.Columns {
-		return nil
+// CellRange returns the first and last rows and columns of the cells overlapping the
+// box [min, max] grown by the margin, clamped to the mesh.
+func (m *Mesh) CellRange(min, max utils.Point, margin float64) (int, int, int, int) {
+	rowStart, columnStart := m.CellCoordinates(min[0]-margin, min[1]-margin)
+	rowEnd, columnEnd := m.CellCoordinates(max[0]+margin, max[1]+margin)
+
+	return clampIndex(rowStart, m.Rows), clampIndex(columnStart, m.Columns),
+		clampIndex(rowEnd, m.Rows), clampIndex(columnEnd, m.Columns)
+}
+
+func clampIndex(index, count int) int {
+	if index < 0 {
+		return 0
+	}
+	if index >= count {
+		return count - 1
 	}
 
-	return &m.Cells[column*m.Rows+row]
+	return index
 }
 
-func (m *Mesh) GetCellWithNeighbors(row, column int) []*Cell {
-	var neighbors []*Cell
+// MoveParticle puts the ball in the cell of the given index, leaving the mesh
+// untouched when it is already there. The balls of a cell are kept sorted by id.
+func (m *Mesh) MoveParticle(particleId, cellIndex int) {
+	for len(m.particleCells) <= particleId {
+		m.particleCells = append(m.particleCells, -1)
+	}
 
-	for i := -1; i <= 1; i++ {
-		for j := -1; j <= 1; j++ {
-			if row+i < 0 || row+i >= m.Rows || column+j < 0 || column+j >= m.Columns {
-				continue
-			}
+	if m.particleCells[particleId] == cellIndex {
+		return
+	}
 
-			neighbors = append(neighbors, &m.Cells[(column+j)*m.Rows+(row+i)])
+	m.RemoveParticle(particleId)
+
+	cell := &m.Cells[cellIndex]
+	cell.ParticlesIds = insertSorted(cell.ParticlesIds, particleId)
+	m.particleCells[particleId] = cellIndex
+}
+
+// PileParticle takes a stopped ball out of the moving balls and adds it for good to
+// the pile of the cell of the given index. A ball already in a pile is left there.
+func (m *Mesh) PileParticle(particleId, cellIndex int) {
+	if m.InPile(particleId) {
+		return
+	}
+
+	for len(m.pileCells) <= particleId {
+		m.pileCells = append(m.pileCells, -1)
+	}
+
+	m.RemoveParticle(particleId)
+
+	cell := &m.Cells[cellIndex]
+	cell.PileIds = insertSorted(cell.PileIds, particleId)
+	m.pileCells[particleId] = cellIndex
+}
+
+// InPile reports whether the ball was added to a pile.
+func (m *Mesh) InPile(particleId int) bool {
+	return particleId < len(m.pileCells) && m.pileCells[particleId] >= 0
+}
+
+// insertSorted inserts the id in the sorted list, so the balls of a cell are visited
+// in the same order whatever the cell went through before.
+func insertSorted(ids []int, id int) []int {
+	slot := len(ids)
+	for slot > 0 && ids[slot-1] > id {
+		slot--
+	}
+
+	ids = append(ids, 0)
+	copy(ids[slot+1:], ids[slot:])
+	ids[slot] = id
+	return ids
+}
+
+// RemoveParticle takes the ball out of its cell, keeping the backing array of the cell.
+func (m *Mesh) RemoveParticle(particleId int) {
+	if particleId >= len(m.particleCells) || m.particleCells[particleId] < 0 {
+		return
+	}
+
+	cell := &m.Cells[m.particleCells[particleId]]
+	for slot, id := range cell.ParticlesIds {
+		if id == particleId {
+			cell.ParticlesIds = append(cell.ParticlesIds[:slot], cell.ParticlesIds[slot+1:]...)
+			break
 		}
 	}
 
-	return neighbors
+	m.particleCells[particleId] = -1
+}
+
+func (m *Mesh) GetCell(row, column int) *Cell {
+	if row < 0 || row >= m.Rows || column < 0 || column >= m.Columns {
+		return nil
+	}
+
+	return &m.Cells[column*m.Rows+row]
 }
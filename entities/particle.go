@@ -1,77 +1,185 @@
 package entities
 
 import (
+	"errors"
 	"go-galtonboard/utils"
 	"log"
 	"math"
-	"math/rand/v2"
 )
 
-// Particle represents a particle
+// Particle represents a particle. The position, velocity and acceleration of the balls
+// point into the contiguous slices of their Balls.
 type Particle struct {
-	Position     utils.Point
-	Velocity     utils.Point
-	Acceleration utils.Point
+	Position     *utils.Point
+	Velocity     *utils.Point
+	Acceleration *utils.Point
 	Damping      float64
 	Radius       float64
 	Type         int
 	IsStopped    bool
 	PrevUpdateD  utils.Point
+	PrevPosition utils.Point
+	PrevVelocity utils.Point
+
+	AngularVelocity float64
+	Inertia         float64
+	Friction        float64
+
+	Mass      float64
+	Species   int
+	Noise     *utils.Random
+	RestSteps int
+
+	Displacement *utils.PegDisplacement
+	Phase        float64
+	NoisePhases  []float64
+
+	BaseRadius     float64
+	Envelope       float64
+	BreathingPhase float64
+	RadialVelocity float64
+
+	InjectedEnergy float64
 }
 
-// NewParticles returns a new particle with the given values.
-func NewParticles(config utils.ParticleConfig, startPoint *utils.Point) []*Particle {
-	particles := make([]*Particle, config.NParticles)
+// Balls holds the state of the balls as a structure of arrays. The kernels walk the
+// contiguous positions, velocities and accelerations, the rest of every ball stays in
+// its Particle.
+type Balls struct {
+	Positions     []utils.Point
+	Velocities    []utils.Point
+	Accelerations []utils.Point
+	Particles     []*Particle
+}
 
-	for i := 0; i < config.NParticles; i++ {
-		randomVx := config.InitDeltaVx * (2*rand.Float64() - 1)
-		randomVy := config.InitDeltaVy * rand.Float64()
+// NewBalls returns the storage of n balls, with every Particle pointing into it.
+func NewBalls(n int) *Balls {
+	b := &Balls{
+		Positions:     make([]utils.Point, n),
+		Velocities:    make([]utils.Point, n),
+		Accelerations: make([]utils.Point, n),
+		Particles:     make([]*Particle, n),
+	}
 
-		randomX := config.InitDeltaX * (2*rand.Float64() - 1)
-		randomY := config.InitDeltaY * rand.Float64()
+	storage := make([]Particle, n)
+	for i := range storage {
+		storage[i].Position = &b.Positions[i]
+		storage[i].Velocity = &b.Velocities[i]
+		storage[i].Acceleration = &b.Accelerations[i]
+		b.Particles[i] = &storage[i]
+	}
 
-		particles[i] = &Particle{
-			Position:    utils.Point{startPoint[0] + randomX, startPoint[1] + randomY},
-			Velocity:    utils.Point{randomVx, randomVy},
-			Damping:     1,
-			Radius:      config.Radius,
-			Type:        utils.Particle,
-			PrevUpdateD: utils.Point{0, 0},
+	return b
+}
+
+// Restore takes the given particles, as read from a checkpoint, and moves their
+// position, velocity and acceleration back into the contiguous slices.
+func (b *Balls) Restore(particles []*Particle) error {
+	if len(particles) != len(b.Particles) {
+		return errors.New("the number of balls does not match the storage")
+	}
+
+	for i, p := range particles {
+		if p.Position == nil || p.Velocity == nil || p.Acceleration == nil {
+			return errors.New("a ball has no position, velocity or acceleration")
 		}
+
+		b.Positions[i] = *p.Position
+		b.Velocities[i] = *p.Velocity
+		b.Accelerations[i] = *p.Acceleration
+		p.Position = &b.Positions[i]
+		p.Velocity = &b.Velocities[i]
+		p.Acceleration = &b.Accelerations[i]
+		b.Particles[i] = p
 	}
 
-	return particles
+	return nil
 }
 
-// NewPegs returns a new peg with the given values.
-func NewPegs(pegConfig utils.PegConfig, boardConfig utils.BoardConfig) ([]*Particle, []*utils.Point) {
-	pegs := make([]*Particle, 0)
-	border := make([]*utils.Point, 5)
+// NewParticles returns the balls with the given values.
+func NewParticles(config utils.ParticleConfig, startPoint *utils.Point, random *utils.Random) *Balls {
+	balls := NewBalls(config.TotalParticles())
+	n := 0
 
-	for i := 0; i < boardConfig.NRows; i++ {
-		for j := 0; j < boardConfig.NCols; j++ {
-			peg := &Particle{}
+	for speciesId, species := range config.SpeciesList() {
+		for i := 0; i < species.NParticles; i++ {
+			randomVx := config.InitDeltaVx * (2*random.Float64() - 1)
+			randomVy := config.InitDeltaVy * random.Float64()
 
-			x := float64(j) * (boardConfig.HorizontalSpace)
-			y := float64(i) * (boardConfig.VerticalSpace)
-			if i%2 != 0 {
-				x += (boardConfig.HorizontalSpace) / 2
+			randomX := config.InitDeltaX * (2*random.Float64() - 1)
+			randomY := config.InitDeltaY * random.Float64()
 
-				if j == boardConfig.NCols-1 {
-					continue
-				}
+			radius := species.MinRadius
+			if species.MaxRadius > species.MinRadius {
+				radius += (species.MaxRadius - species.MinRadius) * random.Float64()
 			}
 
-			peg.Position = utils.Point{x, y}
-			peg.Radius = getRadius(&pegConfig, &boardConfig, y, x)
-			peg.Damping = pegConfig.Damping
-			peg.Type = utils.Peg
-			pegs = append(pegs, peg)
+			p := balls.Particles[n]
+			*p.Position = utils.Point{startPoint[0] + randomX, startPoint[1] + randomY}
+			*p.Velocity = utils.Point{randomVx, randomVy}
+			p.Damping = species.Restitution
+			p.Radius = radius
+			p.Type = utils.Particle
+			p.PrevUpdateD = utils.Point{0, 0}
+			p.Inertia = config.InertiaFactor * species.Mass * radius * radius
+			p.Mass = species.Mass
+			p.Species = speciesId
+			n++
 		}
 	}
 
+	return balls
+}
+
+// NewPeg returns a peg at the given position, with its own position, velocity and
+// acceleration.
+func NewPeg(position utils.Point) *Particle {
+	return &Particle{
+		Position:     &position,
+		Velocity:     &utils.Point{},
+		Acceleration: &utils.Point{},
+		Type:         utils.Peg,
+	}
+}
+
+// NewPegs returns a new peg with the given values. Random lattices and the disorder
+// draw from the given generator.
+func NewPegs(pegConfig utils.PegConfig, boardConfig utils.BoardConfig, random *utils.Random) ([]*Particle, []*utils.Point) {
+	pegs := make([]*Particle, 0)
+	border := make([]*utils.Point, 5)
+
+	// The collection tray sits below the last row of pegs
+	offset := 0.0
+	if boardConfig.Bins.Enabled {
+		offset = boardConfig.Bins.WallHeight
+	}
+
 	width := boardConfig.HorizontalSpace * float64(boardConfig.NCols-1)
-	height := boardConfig.VerticalSpace*float64(boardConfig.NRows-1) + boardConfig.StartHeightParticle
+	latticeHeight := boardConfig.VerticalSpace * float64(boardConfig.NRows-1)
+	height := latticeHeight + boardConfig.StartHeightParticle + offset
+
+	disorder := pegConfig.Disorder
+	for _, site := range latticeSites(&boardConfig, width, latticeHeight, random) {
+		x := site[0]
+		y := site[1]
+
+		// Quenched disorder, the radius still follows the undisturbed site
+		if disorder.Vacancy > 0 && random.Float64() < disorder.Vacancy {
+			continue
+		}
+
+		position := utils.Point{x, y + offset}
+		if disorder.Jitter > 0 {
+			position[0] += disorder.Jitter * random.NormFloat64()
+			position[1] += disorder.Jitter * random.NormFloat64()
+		}
+
+		peg := NewPeg(position)
+		peg.Radius = getRadius(&pegConfig, &boardConfig, y, x)
+		peg.Damping = pegConfig.Damping
+		peg.Friction = pegConfig.Friction
+		pegs = append(pegs, peg)
+	}
 
 	border[0] = &utils.Point{width / 2, height}
 	border[1] = &utils.Point{width, height}
@@ -153,6 +261,42 @@ func getRadius(pegConfig *utils.PegConfig, boardConfig *utils.BoardConfig, row,
 		gauss := math.Exp(-pegConfig.DeltaFactor * math.Pow(distance, 2))
 		return (pegConfig.MaxRadius-pegConfig.MinRadius)*gauss + pegConfig.MinRadius
 
+	case utils.ExpressionDist:
+		expression, err := pegConfig.RadiusExpression()
+		if err != nil {
+			log.Fatal("Invalid radius expression in the config file: ", err)
+		}
+
+		radius := expression.Evaluate(column, row,
+			row/boardConfig.VerticalSpace, column/boardConfig.HorizontalSpace,
+			xMiddle, yMiddle, pegConfig.MinRadius, pegConfig.MaxRadius)
+
+		// Keep the formula inside the radius range of the other distributions
+		if math.IsNaN(radius) {
+			return pegConfig.MinRadius
+		}
+		return math.Max(pegConfig.MinRadius, math.Min(radius, pegConfig.MaxRadius))
+
+	case utils.ImageDist:
+		image := pegConfig.RadiusMap()
+		if image == nil {
+			log.Fatal("The radius image has not been loaded")
+		}
+
+		// The image spans the lattice, its first row at the top of the board. A single
+		// row or column samples the middle of the image.
+		width := boardConfig.HorizontalSpace * float64(boardConfig.NCols-1)
+		height := boardConfig.VerticalSpace * float64(boardConfig.NRows-1)
+		u, v := 0.5, 0.5
+		if width > 0 {
+			u = column / width
+		}
+		if height > 0 {
+			v = 1 - row/height
+		}
+		intensity := image.Sample(u, v, pegConfig.Interpolation)
+		return pegConfig.MinRadius + (pegConfig.MaxRadius-pegConfig.MinRadius)*intensity
+
 	default:
 		log.Fatal("Invalid pegs distribution in the config file. Valid values are: \n" +
 			"HORIZONTAL DISTRIBUTIONS\n" +
@@ -165,7 +309,12 @@ func getRadius(pegConfig *utils.PegConfig, boardConfig *utils.BoardConfig, row,
 			"\t5: Logarithmic distribution\n" +
 			"\t6: Gaussian distribution\n" +
 			"\t7: Inverse Gaussian distribution\n" +
-			"\t8: Sine distribution")
+			"\t8: Sine distribution\n" +
+			"OTHER DISTRIBUTIONS\n" +
+			"\t9: Spheric distribution\n" +
+			"\t10: Spheric Gaussian distribution\n" +
+			"\t11: Expression distribution\n" +
+			"\t12: Image distribution")
 	}
 
 	return 0
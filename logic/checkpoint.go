@@ -0,0 +1,158 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"go-galtonboard/entities"
+	"go-galtonboard/utils"
+	"os"
+)
+
+// Checkpoint holds everything needed to continue a simulation
+type Checkpoint struct {
+	Step           int
+	Time           float64
+	Seed           uint64
+	Random         *utils.Random
+	Particles      []*entities.Particle
+	Pegs           []*entities.Particle
+	HistogramCount []int
+	TunnelingCount int64
+	BallCells      []int
+
+	SpeciesHistogramCount [][]int
+
+	PathsFile     string
+	PathsOffset   int64
+	HistogramFile string
+}
+
+// SaveCheckpoint writes the current state of the simulation to the project route.
+func (e *Engine) SaveCheckpoint() error {
+	checkpoint := Checkpoint{
+		Step:           e.Step,
+		Time:           e.Time,
+		Seed:           e.Seed,
+		Random:         e.Rand,
+		Particles:      e.Particles,
+		Pegs:           e.Pegs,
+		HistogramCount: e.HistogramCount,
+		TunnelingCount: e.TunnelingCount.Load(),
+		BallCells:      e.ballCells,
+
+		SpeciesHistogramCount: e.SpeciesHistogramCount,
+	}
+
+	if e.Configs.SaveConfig.SavePaths {
+		offset, err := e.PathExporter.Flush()
+		if err != nil {
+			return err
+		}
+
+		checkpoint.PathsFile = e.PathExporter.FileName()
+		checkpoint.PathsOffset = offset
+	}
+
+	if e.Configs.SaveConfig.SaveHistogram {
+		checkpoint.HistogramFile = e.HistogramExporter.FileName()
+	}
+
+	// Write to a temporary file first so a crash never leaves a broken checkpoint
+	fileName := checkpointFileName(e.Route)
+	file, err := os.Create(fileName + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(file).Encode(checkpoint)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// LoadCheckpoint reads the latest checkpoint from the project route.
+func LoadCheckpoint(route string) (*Checkpoint, error) {
+	file, err := os.Open(checkpointFileName(route))
+	if err != nil {
+		return nil, errors.New("error opening the checkpoint file")
+	}
+	defer file.Close()
+
+	checkpoint := Checkpoint{}
+	err = json.NewDecoder(file).Decode(&checkpoint)
+	if err != nil {
+		return nil, errors.New("error decoding the checkpoint file")
+	}
+
+	return &checkpoint, nil
+}
+
+func (e *Engine) restoreCheckpoint(checkpoint *Checkpoint) error {
+	if len(checkpoint.Particles) != len(e.Particles) || len(checkpoint.Pegs) != len(e.Pegs) {
+		return errors.New("the checkpoint does not match the configuration file")
+	}
+
+	if len(checkpoint.HistogramCount) != len(e.HistogramCount) || len(checkpoint.SpeciesHistogramCount) != len(e.SpeciesHistogramCount) {
+		return errors.New("the checkpoint does not match the configuration file")
+	}
+
+	if e.Configs.SaveConfig.SavePaths {
+		err := e.PathExporter.OpenFile(checkpoint.PathsFile, checkpoint.PathsOffset)
+		if err != nil {
+			return errors.New("error reopening the paths file")
+		}
+	}
+
+	if e.Configs.SaveConfig.SaveHistogram {
+		err := e.HistogramExporter.OpenFile(checkpoint.HistogramFile, 0)
+		if err != nil {
+			return errors.New("error reopening the histogram file")
+		}
+	}
+
+	// The balls go back into the contiguous storage
+	err := e.Balls.Restore(checkpoint.Particles)
+	if err != nil {
+		return errors.New("the checkpoint does not match the configuration file")
+	}
+
+	// The displacements of the pegs are not state, they keep the ones of the geometry
+	// file, with their schedules
+	for i, peg := range checkpoint.Pegs {
+		peg.Displacement = e.Pegs[i].Displacement
+	}
+
+	e.Step = checkpoint.Step
+	e.Time = checkpoint.Time
+	e.Rand = checkpoint.Random
+	e.Particles = e.Balls.Particles
+	e.Pegs = checkpoint.Pegs
+	e.HistogramCount = checkpoint.HistogramCount
+	e.SpeciesHistogramCount = checkpoint.SpeciesHistogramCount
+	e.TunnelingCount.Store(checkpoint.TunnelingCount)
+
+	// The balls go back to the cells of the last substep, so the next one sees the
+	// walls, the floor and the other balls as the uninterrupted run does
+	if checkpoint.BallCells != nil {
+		if len(checkpoint.BallCells) != len(e.Particles) {
+			return errors.New("the checkpoint does not match the configuration file")
+		}
+
+		e.ballCells = checkpoint.BallCells
+		e.placeBalls()
+	}
+
+	return nil
+}
+
+func checkpointFileName(route string) string {
+	return route + "checkpoint.json"
+}
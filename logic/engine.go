@@ -1,19 +1,29 @@
 package logic
 
 import (
+	"fmt"
 	"go-galtonboard/entities"
 	model "go-galtonboard/models"
 	"go-galtonboard/utils"
 	"log"
+	"math"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Engine struct {
 	Configs utils.Configs
+	Route   string
 
+	// Particles are the balls of Balls, which holds their state contiguously
+	Balls     *entities.Balls
 	Particles []*entities.Particle
 	Pegs      []*entities.Particle
 	Border    []*utils.Point
+	Segments  []*entities.Segment
+	Polygons  []*entities.Polygon
 
 	Model model.PhysicsModel
 	Mesh  entities.Mesh
@@ -26,35 +36,180 @@ type Engine struct {
 	PathExporter      *Exporter
 	HistogramExporter *Exporter
 
-	HistogramCount []int
+	HistogramCount        []int
+	SpeciesHistogramCount [][]int
+
+	Seed uint64
+	Rand *utils.Random
+
+	Step int
+	Time float64
+
+	TunnelingCount atomic.Int64
+
+	// Largest distance from the registered center of a peg to its surface
+	pegReach float64
+
+	collisionPool *WorkerPool
+	cellColours   [9][][2]int
+
+	particlePool  *WorkerPool
+	ballCells     []int
+	sweepWork     []pegWork
+	histogramLock sync.Mutex
 }
 
 // NewEngine returns a new logic with the given values.
-func NewEngine(config utils.Configs, route string) *Engine {
-	pegs, borders := entities.NewPegs(config.PegConfig, config.BoardConfig)
-	particles := entities.NewParticles(config.ParticleConfig, borders[0])
+func NewEngine(config utils.Configs, route string) (*Engine, error) {
+	e, err := newEngine(config, route)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SaveConfig.SavePaths {
+		e.PathExporter.CreateFile("paths")
+	}
+
+	if config.SaveConfig.SaveHistogram {
+		e.HistogramExporter.CreateFile("histogram")
+	}
+
+	if config.PegConfig.Disorder.Export {
+		offset := 0.0
+		if config.BoardConfig.Bins.Enabled {
+			offset = config.BoardConfig.Bins.WallHeight
+		}
+
+		pegExporter := NewExporter(route, outputComment(e.Configs, e.Seed))
+		pegExporter.CreateFile("disorder")
+		pegExporter.WritePegs(e.Pegs, offset)
+		pegExporter.CloseFile()
+	}
+
+	return e, nil
+}
+
+// ResumeEngine returns a logic restored from the latest checkpoint in the route.
+func ResumeEngine(config utils.Configs, route string) (*Engine, error) {
+	checkpoint, err := LoadCheckpoint(route)
+	if err != nil {
+		return nil, err
+	}
+
+	config.EngineConfig.Seed = checkpoint.Seed
+	e, err := newEngine(config, route)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.restoreCheckpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func newEngine(config utils.Configs, route string) (*Engine, error) {
+	seed := config.EngineConfig.Seed
+	if seed == 0 {
+		seed = utils.NewSeed()
+	}
+	log.Println("Using seed", seed, "for", route)
+
+	random := utils.NewRandom(seed)
+	var (
+		pegs    []*entities.Particle
+		borders []*utils.Point
+	)
+
+	if config.BoardConfig.GeometryFile != "" {
+		fileName := config.BoardConfig.GeometryFile
+		if !filepath.IsAbs(fileName) {
+			fileName = route + fileName
+		}
+
+		var err error
+		pegs, borders, err = entities.LoadPegs(fileName, route, config.PegConfig, config.BoardConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		// The tray and the histogram follow the bounding box of the layout
+		config.BoardConfig.NCols = int(math.Ceil(borders[1][0]/config.BoardConfig.HorizontalSpace)) + 1
+		config.BoardConfig.NRows = int(math.Max(math.Ceil(borders[1][1]/config.BoardConfig.VerticalSpace), 1))
+	} else {
+		pegs, borders = entities.NewPegs(config.PegConfig, config.BoardConfig, random)
+	}
+	entities.AssignPhases(pegs, config.PegConfig, config.BoardConfig, random)
+	entities.AssignBreathing(pegs, config.PegConfig, config.BoardConfig)
+	balls := entities.NewParticles(config.ParticleConfig, borders[0], random)
+	particles := balls.Particles
+
+	segments, polygons, err := entities.NewObstacles(config.BoardConfig, borders)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.EngineConfig.Mode == utils.EngineEventDriven {
+		err = checkEventSupport(config, pegs, segments, polygons)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Every ball draws its thermal noise from its own stream
+	if model.IsStochastic(config.EngineConfig.Integrator) {
+		for _, p := range particles {
+			p.Noise = random.Split()
+		}
+	}
 
 	var (
 		pathExporter, histogramExporter *Exporter
 	)
 
+	comment := outputComment(config, seed)
+
 	if config.SaveConfig.SavePaths {
-		pathExporter = NewExporter(route)
-		pathExporter.CreateFile("paths")
+		pathExporter = NewExporter(route, comment)
 	}
 
 	if config.SaveConfig.SaveHistogram {
-		histogramExporter = NewExporter(route)
-		histogramExporter.CreateFile("histogram")
+		histogramExporter = NewExporter(route, comment)
+	}
+
+	speciesHistogramCount := make([][]int, len(config.ParticleConfig.SpeciesList()))
+	for i := range speciesHistogramCount {
+		speciesHistogramCount[i] = make([]int, config.BoardConfig.NCols-1)
+	}
+
+	distance := interactionDistance(pegs, particles, config.PegConfig)
+	cellSize := config.BoardConfig.CellSize
+	if cellSize <= 0 {
+		cellSize = distance
+		// The event engine lets the balls travel up to a cell before looking again
+		if config.EngineConfig.Mode == utils.EngineEventDriven {
+			cellSize *= 2
+		}
+	} else if cellSize < distance {
+		log.Println("The mesh cells of", cellSize, "are smaller than the interaction distance of", distance,
+			", some collisions will be missed")
 	}
+	mesh := entities.NewMesh(borders[1][0], borders[1][1], cellSize)
 
 	return &Engine{
 		Configs:           config,
+		Route:             route,
+		Balls:             balls,
 		Particles:         particles,
 		Pegs:              pegs,
 		Border:            borders,
-		Model:             model.NewDefaultModel(),
-		Mesh:              *entities.NewMesh(config.BoardConfig.NRows, config.BoardConfig.NCols, borders[1][0], borders[1][1]),
+		Segments:          segments,
+		Polygons:          polygons,
+		Model:             model.NewDefaultModel(config.EngineConfig),
+		Mesh:              *mesh,
+		pegReach:          maxPegReach(pegs, config.PegConfig),
 		PathExporter:      pathExporter,
 		HistogramExporter: histogramExporter,
 		HorizontalMax:     borders[1][0],
@@ -62,47 +217,204 @@ func NewEngine(config utils.Configs, route string) *Engine {
 		VerticalMax:       borders[1][1],
 		VerticalMin:       borders[3][1],
 		HistogramCount:    make([]int, config.BoardConfig.NCols-1),
+		Seed:              seed,
+		Rand:              random,
+
+		SpeciesHistogramCount: speciesHistogramCount,
+	}, nil
+}
+
+// interactionDistance returns the largest distance between the centers of two bodies
+// in contact: a ball and the largest peg, breathing and moved by its displacement
+// included, or two balls.
+func interactionDistance(pegs, particles []*entities.Particle, pegConfig utils.PegConfig) float64 {
+	maxBallRadius := 0.0
+	for _, p := range particles {
+		maxBallRadius = math.Max(maxBallRadius, p.Radius)
 	}
+
+	return math.Max(maxPegReach(pegs, pegConfig)+maxBallRadius, 2*maxBallRadius)
 }
 
-// Run runs the logic.
-func (e *Engine) Run() {
-	t := 0.0
-	dtt := e.Configs.EngineConfig.Dt / float64(e.Configs.EngineConfig.SubSteps)
+// maxPegReach returns the largest distance from the registered center of a peg to its
+// surface: its radius, breathing included, plus the reach of its displacement.
+func maxPegReach(pegs []*entities.Particle, pegConfig utils.PegConfig) float64 {
+	maxReach := 0.0
+	for _, peg := range pegs {
+		reach := peg.Radius
+		if pegConfig.Breathing.Enabled {
+			reach = peg.BaseRadius + math.Abs(pegConfig.Breathing.Amplitude)*peg.Envelope
+		}
 
+		displacement := &pegConfig.Displacement
+		if peg.Displacement != nil {
+			displacement = peg.Displacement
+		}
+		maxReach = math.Max(maxReach, reach+displacement.Reach())
+	}
+
+	return maxReach
+}
+
+// outputComment describes the run in the headers of the output files.
+func outputComment(config utils.Configs, seed uint64) string {
+	comment := fmt.Sprintf("seed=%d", seed)
+
+	if len(config.ParticleConfig.Species) > 0 {
+		colors := make([]string, len(config.ParticleConfig.Species))
+		for i, species := range config.ParticleConfig.Species {
+			colors[i] = species.Color
+		}
+		comment += " colors=" + strings.Join(colors, ",")
+	}
+
+	disorder := config.PegConfig.Disorder
+	if disorder.Jitter > 0 || disorder.Vacancy > 0 {
+		comment += fmt.Sprintf(" jitter=%g vacancy=%g", disorder.Jitter, disorder.Vacancy)
+	}
+
+	if model.IsStochastic(config.EngineConfig.Integrator) {
+		langevin := config.EngineConfig.Langevin
+		comment += fmt.Sprintf(" integrator=%d temperature=%g friction=%g", config.EngineConfig.Integrator, langevin.Temperature, langevin.Friction)
+	}
+
+	return comment
+}
+
+// Run runs the logic. It fails when a peg is outside the mesh.
+func (e *Engine) Run() error {
+	err := e.registerObstacles()
+	if err != nil {
+		return err
+	}
+
+	if e.Configs.EngineConfig.Mode == utils.EngineEventDriven {
+		e.runEvents()
+	} else {
+		e.runSteps()
+	}
+
+	if e.Configs.EngineConfig.ContinuousCollisions {
+		log.Println("Tunneling events caught for", e.Route, ":", e.TunnelingCount.Load())
+	}
+
+	if e.Configs.SaveConfig.SavePaths {
+		e.PathExporter.CloseFile()
+	}
+
+	if e.Configs.SaveConfig.SaveHistogram {
+		// Per species columns are only written when the species are configured
+		var speciesCounts [][]int
+		if len(e.Configs.ParticleConfig.Species) > 0 {
+			speciesCounts = e.SpeciesHistogramCount
+		}
+
+		e.HistogramExporter.WriteHistogram(e.HistogramCount, speciesCounts)
+		e.HistogramExporter.CloseFile()
+	}
+
+	if e.Configs.SaveConfig.SaveEnergy {
+		energyExporter := NewExporter(e.Route, outputComment(e.Configs, e.Seed))
+		energyExporter.CreateFile("energy")
+		energyExporter.WriteEnergy(e.Pegs)
+		energyExporter.CloseFile()
+	}
+
+	return err
+}
+
+// registerObstacles adds the pegs, the segments and the polygons to the mesh. It fails
+// when a peg is outside the mesh.
+func (e *Engine) registerObstacles() error {
 	for i := 0; i < len(e.Pegs); i++ {
 		p := e.Pegs[i]
-		e.Mesh.AddParticleToCell(p.Position[0], p.Position[1], utils.Peg, i)
+		err := e.Mesh.AddParticleToCell(p.Position[0], p.Position[1], utils.Peg, i)
+		if err != nil {
+			return fmt.Errorf("peg %d: %v", i, err)
+		}
+	}
+
+	// Obstacles are registered with a margin, so a ball only checks its own cell
+	margin := 0.0
+	for _, p := range e.Particles {
+		margin = math.Max(margin, p.Radius)
+	}
+
+	for i, segment := range e.Segments {
+		min, max := segment.Bounds()
+		e.Mesh.AddObstacleToCells(min, max, margin, utils.ObstacleSegment, i)
+	}
+
+	for i, polygon := range e.Polygons {
+		min, max := polygon.Bounds()
+		e.Mesh.AddObstacleToCells(min, max, margin, utils.ObstaclePolygon, i)
+	}
+
+	return nil
+}
+
+func (e *Engine) runSteps() {
+	dtt := e.Configs.EngineConfig.Dt / float64(e.Configs.EngineConfig.SubSteps)
+
+	e.collisionPool = NewWorkerPool(e.Configs.EngineConfig.ThreadCount)
+	defer e.collisionPool.Close()
+	e.colourCells()
+
+	e.particlePool = NewWorkerPool(e.Configs.EngineConfig.CPUCount)
+	defer e.particlePool.Close()
+
+	// A new run starts the displaced pegs at their t=0 offset, a resumed one keeps its state
+	if e.Time == 0 {
+		for _, p := range e.Pegs {
+			displacement := &e.Configs.PegConfig.Displacement
+			if p.Displacement != nil {
+				displacement = p.Displacement
+			}
+			e.Model.PlacePeg(p, displacement)
+		}
 	}
 
-	for i := 0; i < e.Configs.EngineConfig.MaxSteps; i++ {
+	for e.Step < e.Configs.EngineConfig.MaxSteps {
 		isStopped := e.ValidateStop()
 		if isStopped {
 			break
 		}
 
 		for j := 0; j < e.Configs.EngineConfig.SubSteps; j++ {
-			e.validateConstraintsMesh()
-			e.applyForces()
-			e.updateBodies(t, dtt)
-			e.updateMesh()
-			e.validateCollisionsMesh()
-
-			t += dtt
+			e.subStep(dtt)
 		}
 
-		if e.Configs.SaveConfig.SavePaths {
-			e.PathExporter.WritePath(e.Particles, e.Pegs, e.Border)
-		}
+		e.finishStep()
+	}
+}
+
+// subStep advances the bodies by dt and resolves their contacts.
+func (e *Engine) subStep(dt float64) {
+	e.validateConstraintsMesh()
+	e.applyForces()
+	e.updateBodies(e.Time, dt)
+	e.updateMesh()
+	e.validateCollisionsMesh()
+	if e.Configs.BoardConfig.Bins.Enabled {
+		e.settleParticles()
 	}
 
+	e.Time += dt
+}
+
+// finishStep writes the current frame and saves a checkpoint when one is due.
+func (e *Engine) finishStep() {
 	if e.Configs.SaveConfig.SavePaths {
-		e.PathExporter.CloseFile()
+		e.PathExporter.WritePath(e.Particles, e.Pegs, e.Border)
 	}
 
-	if e.Configs.SaveConfig.SaveHistogram {
-		e.HistogramExporter.WriteHistogram(e.HistogramCount)
-		e.HistogramExporter.CloseFile()
+	e.Step++
+	checkpointInterval := e.Configs.SaveConfig.CheckpointInterval
+	if checkpointInterval > 0 && e.Step%checkpointInterval == 0 {
+		err := e.SaveCheckpoint()
+		if err != nil {
+			log.Println("Error saving the checkpoint for", e.Route, ":", err)
+		}
 	}
 }
 
@@ -123,99 +435,244 @@ func (e *Engine) ValidateStop() bool {
 }
 
 func (e *Engine) applyForces() {
-	for _, p := range e.Particles {
-		if p.IsStopped {
-			continue
-		}
+	accelerations := e.Balls.Accelerations
+	e.particlePool.Run(len(accelerations), func(worker, start, end int) {
+		for i := start; i < end; i++ {
+			if e.Particles[i].IsStopped {
+				continue
+			}
 
-		p.Acceleration = e.Configs.EngineConfig.Gravity
-	}
+			accelerations[i] = e.Configs.EngineConfig.Gravity
+		}
+	})
 }
 
+// updateMesh moves the balls that changed cells. The cells are found by the workers
+// and the moves applied in ball order, so the cells do not depend on the number of
+// workers. Stopped balls leave the moving balls. With the collection tray and the
+// ball collisions they join the static pile of their cell, where the other balls
+// land on them.
 func (e *Engine) updateMesh() {
-	e.Mesh.ClearMesh()
-	for i := 0; i < len(e.Particles); i++ {
-		p := e.Particles[i]
-		e.Mesh.AddParticleToCell(p.Position[0], p.Position[1], utils.Particle, i)
+	if e.ballCells == nil {
+		e.ballCells = make([]int, len(e.Particles))
 	}
-}
 
-func (e *Engine) updateBodies(t, dt float64) {
-	for _, p := range e.Particles {
-		if p.IsStopped {
-			continue
+	e.particlePool.Run(len(e.Particles), func(worker, start, end int) {
+		for i := start; i < end; i++ {
+			p := e.Particles[i]
+			if p.IsStopped {
+				e.ballCells[i] = -1
+				continue
+			}
+
+			e.ballCells[i] = e.Mesh.ClampedCellIndex(p.Position[0], p.Position[1])
 		}
+	})
 
-		e.Model.UpdateBall(p, t, dt)
-	}
+	e.placeBalls()
+}
 
-	for _, p := range e.Pegs {
-		if e.Configs.PegConfig.Displacement.Displacement {
-			e.Model.UpdatePeg(p, t, dt, &e.Configs.PegConfig.Displacement)
+// placeBalls moves the balls to the cells found by updateMesh, in ball order.
+func (e *Engine) placeBalls() {
+	pile := e.Configs.BoardConfig.Bins.Enabled && e.Configs.EngineConfig.BallCollisions
+
+	for i, c := range e.ballCells {
+		switch {
+		case c >= 0:
+			e.Mesh.MoveParticle(i, c)
+		case pile && !e.Mesh.InPile(i):
+			p := e.Particles[i]
+			e.Mesh.PileParticle(i, e.Mesh.ClampedCellIndex(p.Position[0], p.Position[1]))
+		case !pile:
+			e.Mesh.RemoveParticle(i)
 		}
 	}
 }
 
-func (e *Engine) validateCollisionsMesh() {
-	rows := e.Configs.BoardConfig.NRows
-	cols := e.Configs.BoardConfig.NCols
+// updateBodies hands the range of balls of every worker to the integrator, sweeps
+// them against the pegs with the continuous collisions, then moves the pegs.
+func (e *Engine) updateBodies(t, dt float64) {
+	if e.Configs.EngineConfig.ContinuousCollisions && e.sweepWork == nil {
+		e.sweepWork = make([]pegWork, len(e.Particles))
+	}
+
+	e.particlePool.Run(len(e.Particles), func(worker, start, end int) {
+		for i := start; i < end; i++ {
+			p := e.Particles[i]
+			if !p.IsStopped {
+				p.PrevPosition = e.Balls.Positions[i]
+				p.PrevVelocity = e.Balls.Velocities[i]
+			}
+		}
 
-	sliceCount := e.Configs.EngineConfig.ThreadCount
-	sliceWidth := rows / sliceCount
-	sliceHeight := cols / sliceCount
+		e.Model.UpdateBalls(e.Balls, start, end, t, dt)
 
-	maxWidth := 0
-	maxHeight := 0
-	var wg sync.WaitGroup
-	for i := 0; i < sliceCount; i++ {
-		for j := 0; j < sliceCount; j++ {
-			wg.Add(1)
-			go e.solveCollisionThreaded(i*sliceWidth, (i+1)*sliceWidth, j*sliceHeight, (j+1)*sliceHeight, &wg)
+		if !e.Configs.EngineConfig.ContinuousCollisions {
+			return
+		}
 
-			maxWidth = (i + 1) * sliceWidth
-			maxHeight = (j + 1) * sliceHeight
+		for i := start; i < end; i++ {
+			p := e.Particles[i]
+			if !p.IsStopped {
+				e.sweepWork[i].peg, e.sweepWork[i].work = e.sweepPegCollisions(p, dt)
+			}
+		}
+	})
+
+	// The work of the swept impacts is added in ball order, so the injected energy
+	// does not depend on the number of workers
+	for i, hit := range e.sweepWork {
+		if hit.peg != nil {
+			hit.peg.InjectedEnergy += hit.work
+			e.sweepWork[i] = pegWork{}
 		}
 	}
 
-	if maxWidth < rows {
-		wg.Add(1)
-		go e.solveCollisionThreaded(maxWidth, rows, 0, cols, &wg)
+	e.particlePool.Run(len(e.Pegs), func(worker, start, end int) {
+		for _, p := range e.Pegs[start:end] {
+			displacement := &e.Configs.PegConfig.Displacement
+			if p.Displacement != nil {
+				displacement = p.Displacement
+			}
+
+			if displacement.Displacement {
+				e.Model.UpdatePeg(p, t, dt, displacement)
+			}
+
+			if e.Configs.PegConfig.Breathing.Enabled {
+				e.Model.BreathePeg(p, t, dt, &e.Configs.PegConfig.Breathing)
+			}
+		}
+	})
+}
+
+// colourCells splits the cells in nine colours, (i mod 3, j mod 3). Two cells of the
+// same colour are three cells apart, so their neighbourhoods never overlap.
+func (e *Engine) colourCells() {
+	for colour := range e.cellColours {
+		e.cellColours[colour] = nil
 	}
 
-	if maxHeight < cols {
-		wg.Add(1)
-		go e.solveCollisionThreaded(0, maxWidth, maxHeight, cols, &wg)
+	for i := 0; i < e.Mesh.Rows; i++ {
+		for j := 0; j < e.Mesh.Columns; j++ {
+			colour := (i%3)*3 + j%3
+			e.cellColours[colour] = append(e.cellColours[colour], [2]int{i, j})
+		}
 	}
-	wg.Wait()
 }
 
-func (e *Engine) solveCollisionThreaded(iStart, iEnd, jStart, jEnd int, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for i := iStart; i < iEnd; i++ {
-		for j := jStart; j < jEnd; j++ {
-			e.processCell(e.Mesh.GetCell(i, j), i, j)
-		}
+// validateCollisionsMesh resolves the collisions one colour at a time. The cells of
+// a colour are shared between the workers of the pool; as processCell only touches
+// the 3x3 neighbourhood of its cell, no ball is written by two workers at once.
+func (e *Engine) validateCollisionsMesh() {
+	for _, cells := range e.cellColours {
+		e.collisionPool.Run(len(cells), func(worker, start, end int) {
+			for _, cell := range cells[start:end] {
+				e.processCell(e.Mesh.GetCell(cell[0], cell[1]), cell[0], cell[1])
+			}
+		})
 	}
 }
 
 func (e *Engine) processCell(c *entities.Cell, i, j int) {
+	if len(c.ParticlesIds) == 0 {
+		return
+	}
+
+	neighbors := [9]*entities.Cell{
+		c,
+		e.Mesh.GetCell(i-1, j),
+		e.Mesh.GetCell(i+1, j),
+		e.Mesh.GetCell(i, j-1),
+		e.Mesh.GetCell(i, j+1),
+		e.Mesh.GetCell(i-1, j-1),
+		e.Mesh.GetCell(i-1, j+1),
+		e.Mesh.GetCell(i+1, j-1),
+		e.Mesh.GetCell(i+1, j+1),
+	}
+
 	for _, pId := range c.ParticlesIds {
 		if e.Particles[pId].IsStopped {
 			continue
 		}
 
-		e.checkAtomCellCollisions(pId, c)
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i-1, j))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i+1, j))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i, j-1))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i, j+1))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i-1, j-1))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i-1, j+1))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i+1, j-1))
-		e.checkAtomCellCollisions(pId, e.Mesh.GetCell(i+1, j+1))
+		for _, neighbor := range neighbors {
+			e.checkAtomCellCollisions(pId, neighbor)
+		}
+
+		for _, segmentId := range c.SegmentsIds {
+			e.Model.ResolveSegmentCollision(e.Particles[pId], e.Segments[segmentId])
+		}
+
+		for _, polygonId := range c.PolygonsIds {
+			e.Model.ResolvePolygonCollision(e.Particles[pId], e.Polygons[polygonId])
+		}
 	}
 }
 
+// pegWork is the work done by a peg on a ball in the sweep of a substep.
+type pegWork struct {
+	peg  *entities.Particle
+	work float64
+}
+
+// sweepPegCollisions finds the first peg hit along the path travelled by the ball
+// during the substep and returns it with the work it did on the ball. It runs right after the integration of the ball, before any
+// other response of the substep. The pegs are looked up in every cell of the box
+// covering the whole path, grown by the ball radius and the reach of the pegs, so a
+// ball crossing several cells in one substep still sees the pegs it passed. The ball
+// is taken back to the time of impact along its path, the collision is resolved there
+// and the rest of the substep is drifted with the velocity change of the substep, so
+// no noise is drawn twice.
+func (e *Engine) sweepPegCollisions(p *entities.Particle, dt float64) (*entities.Particle, float64) {
+	min := utils.Point{math.Min(p.PrevPosition[0], p.Position[0]), math.Min(p.PrevPosition[1], p.Position[1])}
+	max := utils.Point{math.Max(p.PrevPosition[0], p.Position[0]), math.Max(p.PrevPosition[1], p.Position[1])}
+	rowStart, columnStart, rowEnd, columnEnd := e.Mesh.CellRange(min, max, p.Radius+e.pegReach)
+
+	var hit *entities.Particle
+	impact := 1.0
+	for i := rowStart; i <= rowEnd; i++ {
+		for j := columnStart; j <= columnEnd; j++ {
+			for _, pegId := range e.Mesh.GetCell(i, j).PegsIds {
+				peg := e.Pegs[pegId]
+				s, ok := utils.SweptCircleImpact(&p.PrevPosition, p.Position, peg.Position, p.Radius+peg.Radius)
+				if ok && s < impact {
+					hit = peg
+					impact = s
+				}
+			}
+		}
+	}
+
+	if hit == nil {
+		return nil, 0
+	}
+
+	// The discrete test only sees pegs that still overlap the ball at the end of the substep
+	distanceSquare := utils.DistanceSquare(p.Position, hit.Position)
+	if distanceSquare >= (p.Radius+hit.Radius)*(p.Radius+hit.Radius) {
+		e.TunnelingCount.Add(1)
+	}
+
+	dv := utils.Point{p.Velocity[0] - p.PrevVelocity[0], p.Velocity[1] - p.PrevVelocity[1]}
+	*p.Position = utils.Point{
+		p.PrevPosition[0] + impact*(p.Position[0]-p.PrevPosition[0]),
+		p.PrevPosition[1] + impact*(p.Position[1]-p.PrevPosition[1]),
+	}
+	*p.Velocity = utils.Point{p.PrevVelocity[0] + impact*dv[0], p.PrevVelocity[1] + impact*dv[1]}
+
+	work := e.Model.ResolveCollision(p, hit)
+
+	rest := (1 - impact) * dt
+	*p.Position = utils.Point{
+		p.Position[0] + p.Velocity[0]*rest + 0.5*(1-impact)*dv[0]*rest,
+		p.Position[1] + p.Velocity[1]*rest + 0.5*(1-impact)*dv[1]*rest,
+	}
+	*p.Velocity = utils.Point{p.Velocity[0] + (1-impact)*dv[0], p.Velocity[1] + (1-impact)*dv[1]}
+
+	return hit, work
+}
+
 func (e *Engine) checkAtomCellCollisions(particleId int, c *entities.Cell) {
 	if c == nil {
 		return
@@ -224,49 +681,90 @@ func (e *Engine) checkAtomCellCollisions(particleId int, c *entities.Cell) {
 	p := e.Particles[particleId]
 	for _, pegId := range c.PegsIds {
 		peg := e.Pegs[pegId]
-		distanceSquare := utils.DistanceSquare(&p.Position, &peg.Position)
+		distanceSquare := utils.DistanceSquare(p.Position, peg.Position)
 		if distanceSquare < (p.Radius+peg.Radius)*(p.Radius+peg.Radius) {
-			e.Model.ResolveCollision(p, peg)
+			// Only the cells of one colour reach the peg, so one worker at a time
+			peg.InjectedEnergy += e.Model.ResolveCollision(p, peg)
+		}
+	}
+
+	if !e.Configs.EngineConfig.BallCollisions {
+		return
+	}
+
+	for _, otherId := range c.ParticlesIds {
+		// Each pair of moving balls is resolved once, from the lower id. A ball
+		// stopped in this substep only takes part inside the collection tray.
+		other := e.Particles[otherId]
+		if other.IsStopped {
+			if !e.Configs.BoardConfig.Bins.Enabled {
+				continue
+			}
+		} else if otherId <= particleId {
+			continue
+		}
+
+		distanceSquare := utils.DistanceSquare(p.Position, other.Position)
+		if distanceSquare < (p.Radius+other.Radius)*(p.Radius+other.Radius) {
+			e.Model.ResolveBallCollision(p, other)
+		}
+	}
+
+	for _, otherId := range c.PileIds {
+		other := e.Particles[otherId]
+		distanceSquare := utils.DistanceSquare(p.Position, other.Position)
+		if distanceSquare < (p.Radius+other.Radius)*(p.Radius+other.Radius) {
+			e.Model.ResolveBallCollision(p, other)
 		}
 	}
 }
 
 func (e *Engine) validateConstraintsMesh() {
-	rows := e.Configs.BoardConfig.NRows
-	cols := e.Configs.BoardConfig.NCols
+	rows := e.Mesh.Rows
+	cols := e.Mesh.Columns
 
 	// Top and bottom borders
-	for j := 0; j < cols; j++ {
-		e.processCellConstraints(e.Mesh.GetCell(0, j))
-		e.processCellConstraints(e.Mesh.GetCell(rows-1, j))
-	}
+	e.particlePool.Run(cols, func(worker, start, end int) {
+		for j := start; j < end; j++ {
+			e.processCellConstraints(e.Mesh.GetCell(0, j))
+			if rows > 1 {
+				e.processCellConstraints(e.Mesh.GetCell(rows-1, j))
+			}
+		}
+	})
 
 	// Right and left borders
 	if e.Configs.BoardConfig.Periodic {
-		for i := 0; i < rows; i++ {
-			cell := e.Mesh.GetCell(i, 0)
-			particles := cell.ParticlesIds
-			for _, pId := range particles {
-				p := e.Particles[pId]
-				if p.Position[0]-p.Radius < e.HorizontalMin {
-					p.Position[0] = e.HorizontalMax - p.Radius
+		e.particlePool.Run(rows, func(worker, start, end int) {
+			for i := start; i < end; i++ {
+				cell := e.Mesh.GetCell(i, 0)
+				particles := cell.ParticlesIds
+				for _, pId := range particles {
+					p := e.Particles[pId]
+					if p.Position[0]-p.Radius < e.HorizontalMin {
+						p.Position[0] = e.HorizontalMax - p.Radius
+					}
 				}
-			}
 
-			cell = e.Mesh.GetCell(i, cols-1)
-			particles = cell.ParticlesIds
-			for _, pId := range particles {
-				p := e.Particles[pId]
-				if p.Position[0]+p.Radius > e.HorizontalMax {
-					p.Position[0] = e.HorizontalMin + p.Radius
+				cell = e.Mesh.GetCell(i, cols-1)
+				particles = cell.ParticlesIds
+				for _, pId := range particles {
+					p := e.Particles[pId]
+					if p.Position[0]+p.Radius > e.HorizontalMax {
+						p.Position[0] = e.HorizontalMin + p.Radius
+					}
 				}
 			}
-		}
+		})
 	} else {
-		for i := 1; i < rows; i++ {
-			e.processCellConstraints(e.Mesh.GetCell(i, 0))
-			e.processCellConstraints(e.Mesh.GetCell(i, cols-1))
-		}
+		e.particlePool.Run(rows-1, func(worker, start, end int) {
+			for i := start + 1; i < end+1; i++ {
+				e.processCellConstraints(e.Mesh.GetCell(i, 0))
+				if cols > 1 {
+					e.processCellConstraints(e.Mesh.GetCell(i, cols-1))
+				}
+			}
+		})
 	}
 }
 
@@ -291,14 +789,11 @@ func (e *Engine) processCellConstraints(cell *entities.Cell) {
 			p.Velocity[0] = -p.Velocity[0] * p.Damping
 		}
 
-		if p.Position[1]-p.Radius < e.VerticalMin {
+		// With a collection tray the floor is handled by settleParticles
+		if p.Position[1]-p.Radius < e.VerticalMin && !e.Configs.BoardConfig.Bins.Enabled {
 			p.Position[1] = e.VerticalMin + p.Radius
 			p.Velocity[1] = -p.Velocity[1] * p.Damping
-			p.IsStopped = true
-
-			x := p.Position[0] - e.HorizontalMin
-			col := int(x / e.Configs.BoardConfig.HorizontalSpace)
-			e.HistogramCount[col]++
+			e.collectParticle(p)
 		}
 
 		if p.Position[1]+p.Radius > e.VerticalMax {
@@ -307,3 +802,62 @@ func (e *Engine) processCellConstraints(cell *entities.Cell) {
 		}
 	}
 }
+
+// collectParticle stops a particle that reached the floor, or came to rest in the
+// collection tray, and counts it in its bin.
+func (e *Engine) collectParticle(p *entities.Particle) {
+	p.IsStopped = true
+
+	e.histogramLock.Lock()
+	defer e.histogramLock.Unlock()
+
+	x := p.Position[0] - e.HorizontalMin
+	col := int(x / e.Configs.BoardConfig.HorizontalSpace)
+	if col < 0 {
+		col = 0
+	}
+	if col >= len(e.HistogramCount) {
+		col = len(e.HistogramCount) - 1
+	}
+	e.HistogramCount[col]++
+	e.SpeciesHistogramCount[p.Species][col]++
+}
+
+// settleParticles handles the balls inside the collection tray. They bounce on the
+// floor, the bin walls being regular obstacles, and are counted in their bin once they have stayed
+// slower than RestVelocity for RestSteps substeps.
+func (e *Engine) settleParticles() {
+	bins := e.Configs.BoardConfig.Bins
+
+	e.particlePool.Run(len(e.Particles), func(worker, start, end int) {
+		for _, p := range e.Particles[start:end] {
+			if p.IsStopped {
+				continue
+			}
+
+			if p.Position[1]-p.Radius > e.VerticalMin+bins.WallHeight {
+				p.RestSteps = 0
+				continue
+			}
+
+			if p.Position[1]-p.Radius < e.VerticalMin {
+				p.Position[1] = e.VerticalMin + p.Radius
+				if p.Velocity[1] < 0 {
+					p.Velocity[1] = -p.Velocity[1] * bins.Damping
+				}
+			}
+
+			speedSquare := p.Velocity[0]*p.Velocity[0] + p.Velocity[1]*p.Velocity[1]
+			if speedSquare < bins.RestVelocity*bins.RestVelocity {
+				p.RestSteps++
+			} else {
+				p.RestSteps = 0
+			}
+
+			if p.RestSteps >= bins.RestSteps {
+				*p.Velocity = utils.Point{0, 0}
+				e.collectParticle(p)
+			}
+		}
+	})
+}
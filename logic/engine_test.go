@@ -0,0 +1,496 @@
+package logic
+
+import (
+	"bytes"
+	"go-galtonboard/utils"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testConfig returns the default configuration with a fixed seed and no output files.
+func testConfig(t testing.TB) utils.Configs {
+	route := t.TempDir() + "/"
+	err := utils.CreateBaseConfig(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := utils.LoadConfig(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.EngineConfig.Seed = 42
+	config.SaveConfig = utils.SaveConfig{}
+	return *config
+}
+
+// runEngine runs a simulation of the configuration to the end.
+func runEngine(t testing.TB, config utils.Configs) *Engine {
+	e, err := NewEngine(config, t.TempDir()+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// steppedEngine returns an engine of the configuration, with its obstacles registered
+// and one worker per pool, ready to run substeps.
+func steppedEngine(t testing.TB, config utils.Configs) *Engine {
+	e, err := newEngine(config, t.TempDir()+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.registerObstacles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.collisionPool = NewWorkerPool(1)
+	t.Cleanup(e.collisionPool.Close)
+	e.colourCells()
+
+	e.particlePool = NewWorkerPool(1)
+	t.Cleanup(e.particlePool.Close)
+
+	return e
+}
+
+// The cells of a colour are processed in parallel, the result must not depend on it.
+// Run with -race to also check the colouring.
+func TestBallCollisionsThreadCount(t *testing.T) {
+	config := testConfig(t)
+	config.ParticleConfig.NParticles = 200
+	config.ParticleConfig.Radius = 2
+	config.ParticleConfig.InitDeltaX = 60
+	config.EngineConfig.BallCollisions = true
+	config.EngineConfig.MaxSteps = 3000
+
+	config.EngineConfig.ThreadCount = 1
+	single := runEngine(t, config)
+
+	config.EngineConfig.ThreadCount = 4
+	parallel := runEngine(t, config)
+
+	total := 0
+	for _, count := range single.HistogramCount {
+		total += count
+	}
+	if total == 0 {
+		t.Fatal("no ball reached the floor")
+	}
+
+	if !reflect.DeepEqual(single.HistogramCount, parallel.HistogramCount) {
+		t.Errorf("got histogram %v with 4 threads, want %v", parallel.HistogramCount, single.HistogramCount)
+	}
+
+	for i := range single.Particles {
+		if *single.Particles[i].Position != *parallel.Particles[i].Position {
+			t.Fatalf("ball %d ends at %v with 4 threads, want %v", i, *parallel.Particles[i].Position, *single.Particles[i].Position)
+		}
+	}
+}
+
+// The particle loops are split across the workers, the paths and the energy injected
+// by the pegs must not depend on it. Run with -race to also check the split.
+func TestParticlePoolCPUCount(t *testing.T) {
+	config := testConfig(t)
+	config.ParticleConfig.NParticles = 400
+	config.ParticleConfig.InitDeltaX = 60
+	config.PegConfig.Displacement.Displacement = true
+	config.PegConfig.Displacement.AmplitudeX = 1
+	config.PegConfig.Displacement.FrequencyX = 2
+	config.BoardConfig.Bins.Enabled = true
+	config.EngineConfig.BallCollisions = true
+	config.EngineConfig.Integrator = utils.IntegratorBAOAB
+	config.EngineConfig.ContinuousCollisions = true
+	config.EngineConfig.MaxSteps = 500
+	config.SaveConfig.SavePaths = true
+
+	config.EngineConfig.CPUCount = 1
+	single := runEngine(t, config)
+
+	config.EngineConfig.CPUCount = 4
+	parallel := runEngine(t, config)
+
+	singlePaths, err := os.ReadFile(single.Route + "paths-0.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parallelPaths, err := os.ReadFile(parallel.Route + "paths-0.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(singlePaths, parallelPaths) {
+		t.Error("the paths differ between 1 and 4 CPUs")
+	}
+
+	if !reflect.DeepEqual(single.HistogramCount, parallel.HistogramCount) {
+		t.Errorf("got histogram %v with 4 CPUs, want %v", parallel.HistogramCount, single.HistogramCount)
+	}
+
+	injected := 0.0
+	for i := range single.Pegs {
+		injected += math.Abs(single.Pegs[i].InjectedEnergy)
+		if single.Pegs[i].InjectedEnergy != parallel.Pegs[i].InjectedEnergy {
+			t.Fatalf("peg %d injected %v with 4 CPUs, want %v", i, parallel.Pegs[i].InjectedEnergy, single.Pegs[i].InjectedEnergy)
+		}
+	}
+	if injected == 0 {
+		t.Error("the pegs injected no energy")
+	}
+}
+
+// A resumed run must continue with the balls back in the contiguous storage and in
+// their cells, and end where the uninterrupted run does. The tray case has balls on
+// the walls and in the bins at the checkpoint.
+func TestCheckpointResume(t *testing.T) {
+	tests := []struct {
+		name       string
+		bins       bool
+		initDeltaX float64
+		steps      int
+	}{
+		{"ball collisions", false, 0, 600},
+		{"collection tray", true, 400, 4000},
+	}
+
+	for _, test := range tests {
+		config := testConfig(t)
+		config.EngineConfig.BallCollisions = true
+		config.BoardConfig.Bins.Enabled = test.bins
+		if test.initDeltaX > 0 {
+			config.ParticleConfig.InitDeltaX = test.initDeltaX
+		}
+		config.EngineConfig.MaxSteps = test.steps
+		full := runEngine(t, config)
+
+		route := t.TempDir() + "/"
+		config.SaveConfig.CheckpointInterval = test.steps / 2
+		config.EngineConfig.MaxSteps = test.steps / 2
+		first, err := NewEngine(config, route)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = first.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.EngineConfig.MaxSteps = test.steps
+		resumed, err := ResumeEngine(config, route)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, p := range resumed.Particles {
+			if p.Position != &resumed.Balls.Positions[i] || p.Velocity != &resumed.Balls.Velocities[i] {
+				t.Fatalf("%s: ball %d is not in the contiguous storage after the resume", test.name, i)
+			}
+		}
+
+		for c := range first.Mesh.Cells {
+			want, got := &first.Mesh.Cells[c], &resumed.Mesh.Cells[c]
+			if !sameIds(got.ParticlesIds, want.ParticlesIds) || !sameIds(got.PileIds, want.PileIds) {
+				t.Fatalf("%s: cell %d holds %v and %v after the resume, want %v and %v", test.name, c,
+					got.ParticlesIds, got.PileIds, want.ParticlesIds, want.PileIds)
+			}
+		}
+
+		err = resumed.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range full.Particles {
+			if *full.Particles[i].Position != *resumed.Particles[i].Position {
+				t.Fatalf("%s: ball %d ends at %v after the resume, want %v", test.name, i, *resumed.Particles[i].Position, *full.Particles[i].Position)
+			}
+		}
+
+		if !reflect.DeepEqual(full.HistogramCount, resumed.HistogramCount) {
+			t.Errorf("%s: got histogram %v after the resume, want %v", test.name, resumed.HistogramCount, full.HistogramCount)
+		}
+	}
+}
+
+// sameIds reports whether both lists hold the same ids in the same order.
+func sameIds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Balls released far above the open top must fall back in and be counted.
+func TestBallsOutsideTheBoard(t *testing.T) {
+	config := testConfig(t)
+	config.ParticleConfig.InitDeltaY = 200
+	config.ParticleConfig.InitDeltaVx = 300
+	e := runEngine(t, config)
+
+	total := 0
+	for _, count := range e.HistogramCount {
+		total += count
+	}
+	if total != len(e.Particles) {
+		t.Errorf("got %d balls counted, want %d", total, len(e.Particles))
+	}
+}
+
+// Stopped balls must leave the moving balls of the mesh, and rest in the piles when
+// the other balls can land on them.
+func TestStoppedBallsInPiles(t *testing.T) {
+	config := testConfig(t)
+	config.ParticleConfig.NParticles = 200
+	config.ParticleConfig.InitDeltaX = 60
+	config.BoardConfig.Bins.Enabled = true
+	config.EngineConfig.BallCollisions = true
+	e := runEngine(t, config)
+
+	moving := map[int]bool{}
+	piled := map[int]bool{}
+	for _, cell := range e.Mesh.Cells {
+		for _, id := range cell.ParticlesIds {
+			moving[id] = true
+		}
+		for _, id := range cell.PileIds {
+			piled[id] = true
+		}
+	}
+
+	stopped := 0
+	for i, p := range e.Particles {
+		if !p.IsStopped {
+			continue
+		}
+		stopped++
+		if moving[i] {
+			t.Errorf("stopped ball %d is still among the moving balls", i)
+		}
+		if !piled[i] {
+			t.Errorf("stopped ball %d is not in a pile", i)
+		}
+	}
+
+	if stopped == 0 {
+		t.Fatal("no ball stopped")
+	}
+}
+
+// A ball crossing a small peg and several cells in one substep must bounce off it
+// with the continuous collisions, and tunnel through it without them.
+func TestContinuousCollisions(t *testing.T) {
+	for _, continuous := range []bool{true, false} {
+		config := testConfig(t)
+		config.ParticleConfig.NParticles = 1
+		config.PegConfig.MinRadius = 0.5
+		config.PegConfig.MaxRadius = 0.5
+		config.EngineConfig.ContinuousCollisions = continuous
+		e := steppedEngine(t, config)
+
+		// From 8 above the peg to 8 below it, with cells of 1.5
+		dt := 0.015
+		center := utils.Point{e.HorizontalMax / 2, e.VerticalMax / 2}
+		peg := e.Pegs[0]
+		for _, other := range e.Pegs {
+			if utils.DistanceSquare(other.Position, &center) < utils.DistanceSquare(peg.Position, &center) {
+				peg = other
+			}
+		}
+		p := e.Particles[0]
+		*p.Position = utils.Point{peg.Position[0], peg.Position[1] + 8}
+		*p.Velocity = utils.Point{0, -16 / dt}
+		e.updateMesh()
+		e.subStep(dt)
+
+		if continuous {
+			if p.Velocity[1] <= 0 || p.Position[1] < peg.Position[1] {
+				t.Errorf("the ball went through the peg to %v with velocity %v", *p.Position, *p.Velocity)
+			}
+			if e.TunnelingCount.Load() != 1 {
+				t.Errorf("got %d tunneling events, want 1", e.TunnelingCount.Load())
+			}
+		} else {
+			if p.Velocity[1] >= 0 || p.Position[1] > peg.Position[1]-7 {
+				t.Errorf("the ball stopped at %v with velocity %v without continuous collisions", *p.Position, *p.Velocity)
+			}
+			if e.TunnelingCount.Load() != 0 {
+				t.Errorf("got %d tunneling events without continuous collisions, want 0", e.TunnelingCount.Load())
+			}
+		}
+	}
+}
+
+// The event-driven mode must count the balls as the time-stepped engine does. A few
+// balls still take the other side of a peg, as the stepped engine resolves the impacts
+// a fraction of a substep late, so the histograms may differ by a few balls.
+func TestEventDrivenHistogram(t *testing.T) {
+	config := testConfig(t)
+	config.ParticleConfig.NParticles = 200
+	config.ParticleConfig.InitDeltaX = 200
+	config.PegConfig.MinRadius = 2
+	config.PegConfig.MaxRadius = 2
+	config.BoardConfig.NRows = 3
+	config.BoardConfig.NCols = 12
+	config.EngineConfig.Dt = 0.002
+	config.EngineConfig.SubSteps = 4
+	config.EngineConfig.MaxSteps = 100000
+	stepped := runEngine(t, config)
+
+	config.EngineConfig.Mode = utils.EngineEventDriven
+	event := runEngine(t, config)
+
+	steppedTotal, eventTotal, difference := 0, 0, 0
+	for i := range stepped.HistogramCount {
+		steppedTotal += stepped.HistogramCount[i]
+		eventTotal += event.HistogramCount[i]
+		if stepped.HistogramCount[i] > event.HistogramCount[i] {
+			difference += stepped.HistogramCount[i] - event.HistogramCount[i]
+		} else {
+			difference += event.HistogramCount[i] - stepped.HistogramCount[i]
+		}
+	}
+
+	if steppedTotal != len(stepped.Particles) || eventTotal != len(event.Particles) {
+		t.Fatalf("got %d balls counted by the stepped engine and %d by the events, want %d", steppedTotal, eventTotal, len(stepped.Particles))
+	}
+
+	if difference > len(event.Particles)/20 {
+		t.Errorf("got histogram %v with the events, want about %v", event.HistogramCount, stepped.HistogramCount)
+	}
+}
+
+// The event-driven mode must refuse the features it cannot simulate.
+func TestEventDrivenUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(config *utils.Configs)
+		err    string
+	}{
+		{"ball collisions", func(config *utils.Configs) {
+			config.EngineConfig.BallCollisions = true
+		}, "ball collisions are not supported by the event-driven mode"},
+		{"displacement", func(config *utils.Configs) {
+			config.PegConfig.Displacement.Displacement = true
+		}, "peg displacement is not supported by the event-driven mode"},
+		{"breathing", func(config *utils.Configs) {
+			config.PegConfig.Breathing.Enabled = true
+		}, "breathing pegs are not supported by the event-driven mode"},
+		{"force fields", func(config *utils.Configs) {
+			config.EngineConfig.Forces = []utils.ForceConfig{{Type: utils.ForceLinearDrag, Coefficient: 1}}
+		}, "force fields are not supported by the event-driven mode"},
+		{"collection tray", func(config *utils.Configs) {
+			config.BoardConfig.Bins.Enabled = true
+		}, "the collection tray is not supported by the event-driven mode"},
+		{"obstacles", func(config *utils.Configs) {
+			config.BoardConfig.SolidBorder = true
+		}, "obstacles are not supported by the event-driven mode"},
+		{"thermal noise", func(config *utils.Configs) {
+			config.EngineConfig.Integrator = utils.IntegratorEulerMaruyama
+		}, "thermal noise is not supported by the event-driven mode"},
+	}
+
+	for _, test := range tests {
+		config := testConfig(t)
+		config.EngineConfig.Mode = utils.EngineEventDriven
+		test.modify(&config)
+
+		_, err := NewEngine(config, t.TempDir()+"/")
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	config := testConfig(t)
+	config.EngineConfig.Mode = utils.EngineEventDriven
+	_, err := NewEngine(config, t.TempDir()+"/")
+	if err != nil {
+		t.Errorf("default board: unexpected error %v", err)
+	}
+}
+
+// A peg of the geometry file with its own schedule must keep moving after a resume.
+func TestCheckpointResumeSchedule(t *testing.T) {
+	// The full run has its own route, so the files are given with absolute paths
+	route := t.TempDir() + "/"
+	layout := `[
+		{"X": 0, "Y": 0, "Radius": 3},
+		{"X": 20, "Y": 0, "Radius": 3, "Displacement": {"Displacement": true, "Mode": 5, "ScheduleFile": "` + route + `peg.csv", "Loop": true}},
+		{"X": 40, "Y": 0, "Radius": 3}
+	]`
+
+	err := os.WriteFile(route+"layout.json", []byte(layout), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(route+"peg.csv", []byte("0, 0, 0\n1, 4, 0\n2, 0, 0\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(t)
+	config.ParticleConfig.NParticles = 20
+	config.ParticleConfig.InitDeltaX = 20
+	config.BoardConfig.GeometryFile = route + "layout.json"
+	config.BoardConfig.StartHeightParticle = 200
+	config.EngineConfig.MaxSteps = 400
+	full := runEngine(t, config)
+
+	config.SaveConfig.CheckpointInterval = 200
+	config.EngineConfig.MaxSteps = 200
+	first, err := NewEngine(config, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = first.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.EngineConfig.MaxSteps = 400
+	resumed, err := ResumeEngine(config, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resumed.Pegs[1].Displacement.Schedule() == nil {
+		t.Fatal("the schedule of the peg was lost in the resume")
+	}
+
+	err = resumed.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *resumed.Pegs[1].Position != *full.Pegs[1].Position {
+		t.Errorf("the peg ends at %v after the resume, want %v", *resumed.Pegs[1].Position, *full.Pegs[1].Position)
+	}
+
+	for i := range full.Particles {
+		if *full.Particles[i].Position != *resumed.Particles[i].Position {
+			t.Fatalf("ball %d ends at %v after the resume, want %v", i, *resumed.Particles[i].Position, *full.Particles[i].Position)
+		}
+	}
+}
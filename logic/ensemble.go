@@ -0,0 +1,68 @@
+package logic
+
+import (
+	"fmt"
+	"go-galtonboard/utils"
+	"log"
+	"math"
+)
+
+// RunEnsemble runs one simulation per disorder realisation, realisation r using the
+// seed base+r, and writes the histogram averaged over all of them.
+func RunEnsemble(config utils.Configs, route string) error {
+	realisations := config.PegConfig.Disorder.Realisations
+
+	seed := config.EngineConfig.Seed
+	if seed == 0 {
+		seed = utils.NewSeed()
+	}
+
+	if config.SaveConfig.CheckpointInterval > 0 {
+		log.Println("Checkpoints are not supported by the ensemble runs and will be disabled")
+		config.SaveConfig.CheckpointInterval = 0
+	}
+
+	var sums, squares []float64
+	for r := 0; r < realisations; r++ {
+		realisation := config
+		realisation.EngineConfig.Seed = seed + uint64(r)
+
+		e, err := NewEngine(realisation, route)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Running realisation", r+1, "of", realisations, "for", route)
+		err = e.Run()
+		if err != nil {
+			return err
+		}
+
+		if sums == nil {
+			sums = make([]float64, len(e.HistogramCount))
+			squares = make([]float64, len(e.HistogramCount))
+		}
+
+		for i, count := range e.HistogramCount {
+			sums[i] += float64(count)
+			squares[i] += float64(count) * float64(count)
+		}
+	}
+
+	means := make([]float64, len(sums))
+	deviations := make([]float64, len(sums))
+	for i := range sums {
+		means[i] = sums[i] / float64(realisations)
+		deviations[i] = math.Sqrt(math.Max(squares[i]/float64(realisations)-means[i]*means[i], 0))
+	}
+
+	comment := fmt.Sprintf("seed=%d realisations=%d jitter=%g vacancy=%g", seed, realisations,
+		config.PegConfig.Disorder.Jitter, config.PegConfig.Disorder.Vacancy)
+
+	exporter := NewExporter(route, comment)
+	exporter.CreateFile("ensemble")
+	exporter.WriteEnsemble(means, deviations)
+	exporter.CloseFile()
+
+	return nil
+}
@@ -0,0 +1,389 @@
+package logic
+
+import (
+	"container/heap"
+	"errors"
+	"go-galtonboard/entities"
+	model "go-galtonboard/models"
+	"go-galtonboard/utils"
+	"log"
+	"math"
+)
+
+// Event kinds, ordered by priority when two events happen at the same time
+const (
+	eventFrame = iota
+	eventFloor
+	eventCeiling
+	eventLeftWall
+	eventRightWall
+	eventPeg
+	eventHorizon
+)
+
+// maxEventsPerFrame bounds the collisions of a single ball between two frames, so
+// a ball trapped in an endless sequence of bounces cannot stall the simulation. Such
+// a ball is held in place until the next frame, where it is predicted again.
+const maxEventsPerFrame = 10000
+
+type event struct {
+	time     float64
+	kind     int
+	particle int
+	target   int
+	version  int
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].time != q[j].time {
+		return q[i].time < q[j].time
+	}
+	if q[i].kind != q[j].kind {
+		return q[i].kind < q[j].kind
+	}
+	return q[i].particle < q[j].particle
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// eventScheduler keeps the state of an event-driven run. Every ball is stored at
+// its own local time and only moved when one of its events is processed.
+type eventScheduler struct {
+	queue     eventQueue
+	localTime []float64
+	versions  []int
+	counts    []int
+	held      []bool
+
+	maxPegRadius float64
+	trapped      int
+}
+
+// checkEventSupport returns an error for the features the event-driven mode cannot
+// simulate, so it never runs a different board than the time-stepped engine would.
+func checkEventSupport(config utils.Configs, pegs []*entities.Particle, segments []*entities.Segment, polygons []*entities.Polygon) error {
+	displaced := config.PegConfig.Displacement.Displacement
+	for _, peg := range pegs {
+		if peg.Displacement != nil && peg.Displacement.Displacement {
+			displaced = true
+		}
+	}
+
+	switch {
+	case config.EngineConfig.BallCollisions:
+		return errors.New("ball collisions are not supported by the event-driven mode")
+	case displaced:
+		return errors.New("peg displacement is not supported by the event-driven mode")
+	case config.PegConfig.Breathing.Enabled:
+		return errors.New("breathing pegs are not supported by the event-driven mode")
+	case len(config.EngineConfig.Forces) > 0:
+		return errors.New("force fields are not supported by the event-driven mode")
+	case config.BoardConfig.Bins.Enabled:
+		return errors.New("the collection tray is not supported by the event-driven mode")
+	case len(segments) > 0 || len(polygons) > 0:
+		return errors.New("obstacles are not supported by the event-driven mode")
+	case model.IsStochastic(config.EngineConfig.Integrator):
+		return errors.New("thermal noise is not supported by the event-driven mode")
+	}
+
+	return nil
+}
+
+// runEvents runs the simulation event by event. Between impacts every ball follows
+// an exact parabola, so the scheduler jumps from one predicted collision to the next
+// and only stops at the frame times used by the time-stepped engine.
+func (e *Engine) runEvents() {
+	s := &eventScheduler{
+		localTime: make([]float64, len(e.Particles)),
+		versions:  make([]int, len(e.Particles)),
+		counts:    make([]int, len(e.Particles)),
+		held:      make([]bool, len(e.Particles)),
+	}
+
+	for _, peg := range e.Pegs {
+		s.maxPegRadius = math.Max(s.maxPegRadius, peg.Radius)
+	}
+
+	if e.ValidateStop() {
+		return
+	}
+
+	for i, p := range e.Particles {
+		s.localTime[i] = e.Time
+		if p.IsStopped {
+			continue
+		}
+
+		*p.Acceleration = e.Configs.EngineConfig.Gravity
+		e.clampParticle(p)
+		e.predict(s, i)
+	}
+
+	if e.Step < e.Configs.EngineConfig.MaxSteps {
+		heap.Push(&s.queue, &event{time: float64(e.Step+1) * e.Configs.EngineConfig.Dt, kind: eventFrame})
+	}
+
+	for s.queue.Len() > 0 {
+		ev := heap.Pop(&s.queue).(*event)
+
+		if ev.kind == eventFrame {
+			if !e.processFrame(s, ev.time) {
+				break
+			}
+			continue
+		}
+
+		if ev.version != s.versions[ev.particle] || e.Particles[ev.particle].IsStopped {
+			continue
+		}
+
+		e.processEvent(s, ev)
+	}
+
+	if s.trapped > 0 {
+		log.Println("Balls held until the next frame after endless bounces for", e.Route, ":", s.trapped)
+	}
+
+	remaining := 0
+	for _, p := range e.Particles {
+		if !p.IsStopped {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		log.Println("Balls not counted when the run ended for", e.Route, ":", remaining)
+	}
+}
+
+// processFrame moves every ball to the frame time and writes the frame. It returns
+// false once the simulation is over.
+func (e *Engine) processFrame(s *eventScheduler, t float64) bool {
+	for i, p := range e.Particles {
+		s.counts[i] = 0
+		if p.IsStopped {
+			continue
+		}
+
+		if !s.held[i] {
+			advanceParticle(p, t-s.localTime[i])
+		}
+		s.localTime[i] = t
+	}
+
+	e.Time = t
+	e.finishStep()
+
+	if e.Step >= e.Configs.EngineConfig.MaxSteps || e.ValidateStop() {
+		return false
+	}
+
+	for i, p := range e.Particles {
+		if s.held[i] {
+			s.held[i] = false
+			if !p.IsStopped {
+				e.predict(s, i)
+			}
+		}
+	}
+
+	heap.Push(&s.queue, &event{time: float64(e.Step+1) * e.Configs.EngineConfig.Dt, kind: eventFrame})
+	return true
+}
+
+func (e *Engine) processEvent(s *eventScheduler, ev *event) {
+	p := e.Particles[ev.particle]
+	advanceParticle(p, ev.time-s.localTime[ev.particle])
+	s.localTime[ev.particle] = ev.time
+
+	switch ev.kind {
+	case eventFloor:
+		p.Position[1] = e.VerticalMin + p.Radius
+		p.Velocity[1] = -p.Velocity[1] * p.Damping
+		e.collectParticle(p)
+
+	case eventCeiling:
+		p.Position[1] = e.VerticalMax - p.Radius
+		p.Velocity[1] = -p.Velocity[1] * p.Damping
+
+	case eventLeftWall:
+		if e.Configs.BoardConfig.Periodic {
+			p.Position[0] = e.HorizontalMax - p.Radius
+		} else {
+			p.Position[0] = e.HorizontalMin + p.Radius
+			p.Velocity[0] = -p.Velocity[0] * p.Damping
+		}
+
+	case eventRightWall:
+		if e.Configs.BoardConfig.Periodic {
+			p.Position[0] = e.HorizontalMin + p.Radius
+		} else {
+			p.Position[0] = e.HorizontalMax - p.Radius
+			p.Velocity[0] = -p.Velocity[0] * p.Damping
+		}
+
+	case eventPeg:
+		peg := e.Pegs[ev.target]
+		peg.InjectedEnergy += e.Model.ResolveCollision(p, peg)
+	}
+
+	s.versions[ev.particle]++
+	if p.IsStopped {
+		return
+	}
+
+	s.counts[ev.particle]++
+	if s.counts[ev.particle] > maxEventsPerFrame {
+		s.held[ev.particle] = true
+		s.trapped++
+		return
+	}
+
+	e.predict(s, ev.particle)
+}
+
+// predict schedules the next event of a ball. Pegs are only searched in the
+// neighbouring cells, and the prediction is limited to the time the ball needs to
+// leave them; a horizon event then triggers a new prediction.
+func (e *Engine) predict(s *eventScheduler, particleId int) {
+	p := e.Particles[particleId]
+	t0 := s.localTime[particleId]
+	g := *p.Acceleration
+
+	next := &event{time: math.Inf(1), particle: particleId, version: s.versions[particleId]}
+	schedule := func(dt float64, kind, target int) {
+		if t0+dt < next.time {
+			next.time = t0 + dt
+			next.kind = kind
+			next.target = target
+		}
+	}
+
+	cellWidth, cellHeight := e.Mesh.CellSize()
+	reach := math.Min(cellWidth, cellHeight) - p.Radius - s.maxPegRadius
+	horizon := math.Inf(1)
+	if reach > 0 {
+		horizon = travelTime(p, reach)
+		schedule(horizon, eventHorizon, 0)
+	}
+
+	// Walls, written as polynomials that become non-positive on contact
+	floor := utils.Polynomial{p.Position[1] - p.Radius - e.VerticalMin, p.Velocity[1], 0.5 * g[1]}
+	ceiling := utils.Polynomial{e.VerticalMax - p.Radius - p.Position[1], -p.Velocity[1], -0.5 * g[1]}
+	left := utils.Polynomial{p.Position[0] - p.Radius - e.HorizontalMin, p.Velocity[0], 0.5 * g[0]}
+	right := utils.Polynomial{e.HorizontalMax - p.Radius - p.Position[0], -p.Velocity[0], -0.5 * g[0]}
+
+	walls := []utils.Polynomial{floor, ceiling, left, right}
+	kinds := []int{eventFloor, eventCeiling, eventLeftWall, eventRightWall}
+	for i, wall := range walls {
+		dt, ok := wall.FirstEntry(0, math.Min(horizon, next.time-t0))
+		if ok {
+			schedule(dt, kinds[i], 0)
+		}
+	}
+
+	checkPeg := func(pegId int) {
+		peg := e.Pegs[pegId]
+		dt, ok := pegPolynomial(p, peg).FirstEntry(0, math.Min(horizon, next.time-t0))
+		if ok {
+			schedule(dt, eventPeg, pegId)
+		}
+	}
+
+	if reach > 0 {
+		row, column := e.Mesh.CellCoordinates(p.Position[0], p.Position[1])
+		for i := -1; i <= 1; i++ {
+			for j := -1; j <= 1; j++ {
+				c := e.Mesh.GetCell(row+i, column+j)
+				if c == nil {
+					continue
+				}
+
+				for _, pegId := range c.PegsIds {
+					checkPeg(pegId)
+				}
+			}
+		}
+	} else {
+		// Pegs larger than the cells, every peg has to be checked
+		for pegId := range e.Pegs {
+			checkPeg(pegId)
+		}
+	}
+
+	if !math.IsInf(next.time, 1) {
+		heap.Push(&s.queue, next)
+	}
+}
+
+// clampParticle moves a ball that starts outside the board back inside it, as the
+// constraints of the time-stepped engine do.
+func (e *Engine) clampParticle(p *entities.Particle) {
+	if p.Position[0]-p.Radius < e.HorizontalMin {
+		p.Position[0] = e.HorizontalMin + p.Radius
+	}
+
+	if p.Position[0]+p.Radius > e.HorizontalMax {
+		p.Position[0] = e.HorizontalMax - p.Radius
+	}
+
+	if p.Position[1]+p.Radius > e.VerticalMax {
+		p.Position[1] = e.VerticalMax - p.Radius
+	}
+}
+
+// pegPolynomial returns the squared distance between a ball and a peg minus the
+// squared contact distance, as a polynomial of the time along the ball's parabola.
+func pegPolynomial(p, peg *entities.Particle) utils.Polynomial {
+	ax := 0.5 * p.Acceleration[0]
+	ay := 0.5 * p.Acceleration[1]
+	bx := p.Velocity[0]
+	by := p.Velocity[1]
+	cx := p.Position[0] - peg.Position[0]
+	cy := p.Position[1] - peg.Position[1]
+	radius := p.Radius + peg.Radius
+
+	return utils.Polynomial{
+		cx*cx + cy*cy - radius*radius,
+		2 * (bx*cx + by*cy),
+		bx*bx + by*by + 2*(ax*cx+ay*cy),
+		2 * (ax*bx + ay*by),
+		ax*ax + ay*ay,
+	}
+}
+
+// travelTime returns the time a ball needs to cover the given distance in the worst case.
+func travelTime(p *entities.Particle, distance float64) float64 {
+	speed := math.Hypot(p.Velocity[0], p.Velocity[1])
+	acceleration := math.Hypot(p.Acceleration[0], p.Acceleration[1])
+
+	if acceleration == 0 {
+		if speed == 0 {
+			return math.Inf(1)
+		}
+		return distance / speed
+	}
+
+	return (-speed + math.Sqrt(speed*speed+2*acceleration*distance)) / acceleration
+}
+
+// advanceParticle moves a ball along its parabola.
+func advanceParticle(p *entities.Particle, dt float64) {
+	p.Position[0] += p.Velocity[0]*dt + 0.5*p.Acceleration[0]*dt*dt
+	p.Position[1] += p.Velocity[1]*dt + 0.5*p.Acceleration[1]*dt*dt
+	p.Velocity[0] += p.Acceleration[0] * dt
+	p.Velocity[1] += p.Acceleration[1] * dt
+}
@@ -6,19 +6,23 @@ import (
 	"fmt"
 	"go-galtonboard/entities"
 	"go-galtonboard/utils"
+	"io"
 	"log"
 	"os"
 )
 
 type Exporter struct {
-	path   string
-	file   *os.File
-	writer *bufio.Writer
+	path    string
+	comment string
+	file    *os.File
+	writer  *bufio.Writer
 }
 
-func NewExporter(path string) *Exporter {
+// NewExporter returns a new exporter whose outputs are tagged with the given comment.
+func NewExporter(path, comment string) *Exporter {
 	return &Exporter{
-		path: path,
+		path:    path,
+		comment: comment,
 	}
 }
 
@@ -39,6 +43,45 @@ func (e *Exporter) CreateFile(name string) {
 	e.writer = writer
 }
 
+// OpenFile reopens an existing output file, discarding everything written after offset.
+func (e *Exporter) OpenFile(fileName string, offset int64) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(offset)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	e.file = file
+	e.writer = bufio.NewWriterSize(file, 128*1024*4)
+	return nil
+}
+
+// Flush writes the buffered content to the file and returns its current size.
+func (e *Exporter) Flush() (int64, error) {
+	err := e.writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return e.file.Seek(0, io.SeekCurrent)
+}
+
+// FileName returns the name of the file being written.
+func (e *Exporter) FileName() string {
+	return e.file.Name()
+}
+
 func (e *Exporter) CloseFile() {
 	err := e.writer.Flush()
 	if err != nil {
@@ -60,7 +103,7 @@ func (e *Exporter) Write(content string) {
 
 func (e *Exporter) WritePath(particles, pegs []*entities.Particle, borders []*utils.Point) {
 	total := len(particles) + len(borders) + len(pegs)
-	e.Write(getExportHeader(total))
+	e.Write(getExportHeader(total, e.comment))
 
 	for i, sphere := range particles {
 		e.Write(getExportPath(i, sphere))
@@ -77,45 +120,89 @@ func (e *Exporter) WritePath(particles, pegs []*entities.Particle, borders []*ut
 	}
 }
 
-func (e *Exporter) WriteHistogram(counts []int) {
-	e.Write(getExportHistogram(counts))
+// WriteHistogram writes the total counts per bin, followed by one column per species.
+func (e *Exporter) WriteHistogram(counts []int, speciesCounts [][]int) {
+	e.Write("# " + e.comment + "\n")
+	e.Write(getExportHistogram(counts, speciesCounts))
 }
 
-func getExportHistogram(counts []int) string {
+// WritePegs writes the pegs in the format of the geometry files, removing the height
+// of the collection tray.
+func (e *Exporter) WritePegs(pegs []*entities.Particle, offset float64) {
+	e.Write("# " + e.comment + "\n")
+	e.Write("x,y,radius,damping\n")
+	for _, peg := range pegs {
+		// A breathing peg is written with its rest radius
+		radius := peg.Radius
+		if peg.BaseRadius > 0 {
+			radius = peg.BaseRadius
+		}
+		e.Write(fmt.Sprintf("%g,%g,%g,%g\n", peg.Position[0], peg.Position[1]-offset, radius, peg.Damping))
+	}
+}
+
+// WriteEnergy writes the energy injected by every peg into the balls.
+func (e *Exporter) WriteEnergy(pegs []*entities.Particle) {
+	e.Write("# " + e.comment + "\n")
+	for i, peg := range pegs {
+		e.Write(fmt.Sprintf("%d\t%f\t%f\t%g\n", i, peg.Position[0], peg.Position[1], peg.InjectedEnergy))
+	}
+}
+
+// WriteEnsemble writes the mean count per bin and its standard deviation.
+func (e *Exporter) WriteEnsemble(means, deviations []float64) {
+	e.Write("# " + e.comment + "\n")
+	for i := range means {
+		e.Write(fmt.Sprintf("%d\t%f\t%f\n", i+1, means[i], deviations[i]))
+	}
+}
+
+func getExportHistogram(counts []int, speciesCounts [][]int) string {
 	content := ""
 	for i := 0; i < len(counts); i++ {
-		content += fmt.Sprintf("%d\t%d\n", i+1, counts[i])
+		content += fmt.Sprintf("%d\t%d", i+1, counts[i])
+		for _, species := range speciesCounts {
+			content += fmt.Sprintf("\t%d", species[i])
+		}
+		content += "\n"
 	}
 
 	return content
 }
 
 func getExportPath(number int, sphere *entities.Particle) string {
-	content := fmt.Sprintf("%d \t %d \t %f \t %f \t %f \n",
+	species := -1
+	if sphere.Type == utils.Particle {
+		species = sphere.Species
+	}
+
+	content := fmt.Sprintf("%d \t %d \t %f \t %f \t %f \t %d \n",
 		number,
 		sphere.Type,
 		sphere.Position[0],
 		sphere.Position[1],
 		sphere.Radius,
+		species,
 	)
 
 	return content
 }
 
 func getExportPathBorders(number int, point *utils.Point) string {
-	content := fmt.Sprintf("%d \t %d \t %f \t %f \t %f \n",
+	content := fmt.Sprintf("%d \t %d \t %f \t %f \t %f \t %d \n",
 		number,
 		2,
 		point[0],
 		point[1],
 		0.5,
+		-1,
 	)
 
 	return content
 }
 
-func getExportHeader(total int) string {
-	content := fmt.Sprintf("%d\naver\n", total)
+func getExportHeader(total int, comment string) string {
+	content := fmt.Sprintf("%d\n%s\n", total, comment)
 	return content
 }
 
@@ -0,0 +1,77 @@
+package logic
+
+import "sync"
+
+// WorkerPool runs work on a fixed set of goroutines. Every call to Run splits the
+// tasks statically, in contiguous ranges, so each worker always gets the same share.
+type WorkerPool struct {
+	workers int
+	jobs    []chan poolJob
+	done    sync.WaitGroup
+}
+
+type poolJob struct {
+	start int
+	end   int
+	work  func(worker, start, end int)
+}
+
+// NewWorkerPool starts a pool with the given number of workers, at least one. A
+// single worker runs the work on the calling goroutine.
+func NewWorkerPool(workers int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := &WorkerPool{workers: workers}
+	if workers == 1 {
+		return pool
+	}
+
+	pool.jobs = make([]chan poolJob, workers)
+	for i := range pool.jobs {
+		pool.jobs[i] = make(chan poolJob)
+		go pool.listen(pool.jobs[i], i)
+	}
+
+	return pool
+}
+
+// Workers returns the number of workers of the pool.
+func (p *WorkerPool) Workers() int {
+	return p.workers
+}
+
+func (p *WorkerPool) listen(jobs chan poolJob, worker int) {
+	for job := range jobs {
+		job.work(worker, job.start, job.end)
+		p.done.Done()
+	}
+}
+
+// Run splits the tasks [0, count) between the workers and waits for all of them.
+func (p *WorkerPool) Run(count int, work func(worker, start, end int)) {
+	if p.workers == 1 {
+		work(0, 0, count)
+		return
+	}
+
+	for i := 0; i < p.workers; i++ {
+		start := count * i / p.workers
+		end := count * (i + 1) / p.workers
+		if start == end {
+			continue
+		}
+
+		p.done.Add(1)
+		p.jobs[i] <- poolJob{start: start, end: end, work: work}
+	}
+	p.done.Wait()
+}
+
+// Close stops the workers.
+func (p *WorkerPool) Close() {
+	for _, jobs := range p.jobs {
+		close(jobs)
+	}
+}
@@ -18,6 +18,7 @@ func main() {
 	createDefaultConfig := flag.Bool("default", false, "Create a default configuration file")
 	debug := flag.Bool("debug", false, "Enable debug mode, which use default values for the configuration (boolean)")
 	cpuCount := flag.Int("cpu", 1, "Number of CPUs to use")
+	resume := flag.Bool("resume", false, "Continue the simulations from their latest checkpoint")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Copyright (c) 2024 Nicolas Aguilera García \nUsage: go-galtonboard [flags]")
 		flag.PrintDefaults()
@@ -47,7 +48,7 @@ func main() {
 	var wg sync.WaitGroup
 	for _, projectRoute := range projectRoutes {
 		wg.Add(1)
-		go runConfiguration(projectRoute, *createDefaultConfig, &wg)
+		go runConfiguration(projectRoute, *createDefaultConfig, *resume, &wg)
 	}
 	wg.Wait()
 
@@ -56,7 +57,7 @@ func main() {
 	log.Println("All simulations finished in:", elapsed)
 }
 
-func runConfiguration(projectRoute string, createDefaultConfig bool, group *sync.WaitGroup) {
+func runConfiguration(projectRoute string, createDefaultConfig, resume bool, group *sync.WaitGroup) {
 	defer group.Done()
 
 	if createDefaultConfig {
@@ -69,15 +70,49 @@ func runConfiguration(projectRoute string, createDefaultConfig bool, group *sync
 
 	config, err := utils.LoadConfig(projectRoute)
 	if err != nil {
-		log.Println("Error loading the configuration file for", projectRoute)
+		log.Println("Error loading the configuration file for", projectRoute, ":", err)
 		return
 	}
 
-	engine := logic.NewEngine(*config, projectRoute)
+	if config.PegConfig.Disorder.Realisations > 1 {
+		if resume {
+			log.Println("Ensemble runs cannot be resumed, starting", projectRoute, "from scratch")
+		}
+
+		log.Println("Running ensemble for: ", projectRoute)
+		start := time.Now()
+		err = logic.RunEnsemble(*config, projectRoute)
+		if err != nil {
+			log.Println("Error running the ensemble for", projectRoute, ":", err)
+			return
+		}
+		log.Println("Ensemble for", projectRoute, "finished in:", time.Since(start))
+		return
+	}
+
+	var engine *logic.Engine
+	if resume {
+		engine, err = logic.ResumeEngine(*config, projectRoute)
+		if err != nil {
+			log.Println("Error resuming the simulation for", projectRoute, ":", err)
+			return
+		}
+		log.Println("Resuming simulation for", projectRoute, "from step", engine.Step)
+	} else {
+		engine, err = logic.NewEngine(*config, projectRoute)
+		if err != nil {
+			log.Println("Error creating the simulation for", projectRoute, ":", err)
+			return
+		}
+	}
 
 	log.Println("Running simulation for: ", projectRoute)
 	start := time.Now()
-	engine.Run()
+	err = engine.Run()
+	if err != nil {
+		log.Println("Error running the simulation for", projectRoute, ":", err)
+		return
+	}
 	elapsed := time.Since(start)
 	log.Println("Simulation for", projectRoute, "finished in:", elapsed)
 }
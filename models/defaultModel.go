@@ -3,26 +3,27 @@ package model
 import (
 	"go-galtonboard/entities"
 	"go-galtonboard/utils"
+	"log"
 	"math"
 )
 
 type DefaultModel struct {
-	Runge RungeKutta
+	Integrator Integrator
+	Forces     []ForceField
 }
 
-func NewDefaultModel() *DefaultModel {
-	return &DefaultModel{
-		Runge: RungeKutta{
-			f1: dPosition,
-			f2: dVelocity,
-		},
+func NewDefaultModel(config utils.EngineConfig) *DefaultModel {
+	dm := &DefaultModel{
+		Forces: NewForceFields(config.Forces),
 	}
+	dm.Integrator = NewIntegrator(config, dPosition, dm.dVelocity)
+
+	return dm
 }
 
-func (dm *DefaultModel) UpdateBall(particle *entities.Particle, t, dt float64) {
-	state := dm.Runge.RungeKutta4(dt, t, &particle.Position, &particle.Velocity, &particle.Acceleration)
-	particle.Position = *state.Position
-	particle.Velocity = *state.Velocity
+// UpdateBalls integrates the balls [start, end) of the storage over dt.
+func (dm *DefaultModel) UpdateBalls(balls *entities.Balls, start, end int, t, dt float64) {
+	dm.Integrator.Step(balls, start, end, t, dt)
 }
 
 func (dm *DefaultModel) UpdatePeg(particle *entities.Particle, t, dt float64, displacement *utils.PegDisplacement) {
@@ -32,44 +33,349 @@ func (dm *DefaultModel) UpdatePeg(particle *entities.Particle, t, dt float64, di
 
 	px := particle.Position[0]
 	py := particle.Position[1]
-	npx := displacement.AmplitudeX * math.Cos(displacement.FrequencyX*t)
-	npy := displacement.AmplitudeY * math.Sin(displacement.FrequencyY*t)
+	npx, npy := displacementOffset(particle, t, displacement)
 
 	newDx := particle.PrevUpdateD[0] - npx
 	newDy := particle.PrevUpdateD[1] - npy
 
 	particle.PrevUpdateD = [2]float64{npx, npy}
-	particle.Position = [2]float64{px + newDx, py + newDy}
+	*particle.Position = [2]float64{px + newDx, py + newDy}
+	*particle.Velocity = [2]float64{newDx / dt, newDy / dt}
+}
+
+// PlacePeg moves a displaced peg to its offset at t=0, so the first UpdatePeg starts
+// from rest instead of jumping there.
+func (dm *DefaultModel) PlacePeg(particle *entities.Particle, displacement *utils.PegDisplacement) {
+	if !displacement.Displacement {
+		return
+	}
+
+	npx, npy := displacementOffset(particle, 0, displacement)
+	particle.PrevUpdateD = [2]float64{npx, npy}
+	*particle.Position = [2]float64{particle.Position[0] - npx, particle.Position[1] - npy}
+}
+
+// BreathePeg sets the radius of a breathing peg at time t and the speed of its surface.
+func (dm *DefaultModel) BreathePeg(particle *entities.Particle, t, dt float64, breathing *utils.BreathingConfig) {
+	radius := particle.BaseRadius + breathing.Amplitude*particle.Envelope*math.Sin(breathing.Frequency*t+particle.BreathingPhase)
+	radius = math.Max(radius, 0)
+
+	particle.RadialVelocity = (radius - particle.Radius) / dt
+	particle.Radius = radius
+}
+
+// displacementOffset returns the displacement of a peg at time t. The noise keeps the
+// mean square of a single oscillation of the same amplitude.
+func displacementOffset(peg *entities.Particle, t float64, displacement *utils.PegDisplacement) (float64, float64) {
+	switch displacement.Mode {
+	case utils.DisplacementUniform:
+		return displacement.AmplitudeX * math.Cos(displacement.FrequencyX*t),
+			displacement.AmplitudeY * math.Sin(displacement.FrequencyY*t)
+
+	case utils.DisplacementTravelingWave, utils.DisplacementRandomPhase:
+		return displacement.AmplitudeX * math.Cos(displacement.FrequencyX*t-peg.Phase),
+			displacement.AmplitudeY * math.Sin(displacement.FrequencyY*t-peg.Phase)
+
+	case utils.DisplacementStandingWave:
+		envelope := math.Cos(peg.Phase)
+		return displacement.AmplitudeX * envelope * math.Cos(displacement.FrequencyX*t),
+			displacement.AmplitudeY * envelope * math.Sin(displacement.FrequencyY*t)
+
+	case utils.DisplacementNoise:
+		n := len(peg.NoisePhases) / 2
+		if n == 0 {
+			return 0, 0
+		}
+
+		var x, y float64
+		for k := 0; k < n; k++ {
+			frequency := displacement.FrequencyMin
+			if n > 1 {
+				frequency += float64(k) * (displacement.FrequencyMax - displacement.FrequencyMin) / float64(n-1)
+			}
+			x += math.Cos(frequency*t + peg.NoisePhases[k])
+			y += math.Cos(frequency*t + peg.NoisePhases[n+k])
+		}
+
+		scale := 1 / math.Sqrt(float64(n))
+		return displacement.AmplitudeX * scale * x, displacement.AmplitudeY * scale * y
+
+	case utils.DisplacementSchedule:
+		schedule := displacement.Schedule()
+		if schedule == nil {
+			return 0, 0
+		}
+
+		// UpdatePeg moves the pegs against the offset, the schedule holds the displacement itself
+		x, y := schedule.At(t, displacement.Loop)
+		return -x, -y
+
+	default:
+		log.Fatal("Invalid displacement mode in the config file. Valid values are: \n" +
+			"\t0: Uniform\n" +
+			"\t1: Traveling wave\n" +
+			"\t2: Standing wave\n" +
+			"\t3: Random phase\n" +
+			"\t4: Noise\n" +
+			"\t5: Schedule")
+	}
+
+	return 0, 0
 }
 
-func (dm *DefaultModel) ResolveCollision(ball *entities.Particle, peg *entities.Particle) {
+// ResolveCollision reflects the ball in the rest frame of the peg surface, so a moving
+// or breathing peg pushes the ball. It returns the work done by the peg, which the
+// caller adds to the InjectedEnergy of the peg.
+func (dm *DefaultModel) ResolveCollision(ball *entities.Particle, peg *entities.Particle) float64 {
 	dx := ball.Position[0] - peg.Position[0]
 	dy := ball.Position[1] - peg.Position[1]
 	sumRadius := ball.Radius + peg.Radius
 
-	vxa := ball.Velocity[0]
-	vya := ball.Velocity[1]
-	alpha0 := peg.Damping
-
 	hip := math.Sqrt(dx*dx + dy*dy)
 	sineAngle := dy / hip
 	cosineAngle := dx / hip
 
-	vTangent := -vxa*sineAngle + vya*cosineAngle
-	vRadial := -alpha0 * (vxa*cosineAngle + vya*sineAngle)
-	vxNew := vRadial*cosineAngle - vTangent*sineAngle
-	vyNew := vRadial*sineAngle + vTangent*cosineAngle
+	// Velocity of the peg surface at the contact, a breathing peg also grows along the normal
+	pvx := peg.Velocity[0] + peg.RadialVelocity*cosineAngle
+	pvy := peg.Velocity[1] + peg.RadialVelocity*sineAngle
+
+	vxa := ball.Velocity[0] - pvx
+	vya := ball.Velocity[1] - pvy
+	// The restitution of the species multiplies the damping of the peg, as between two balls
+	alpha0 := peg.Damping * ball.Damping
+
 	newX := sumRadius*cosineAngle + peg.Position[0]
 	newY := sumRadius*sineAngle + peg.Position[1]
 
-	ball.Position = [2]float64{newX, newY}
-	ball.Velocity = [2]float64{vxNew, vyNew}
+	// A ball already moving away from the surface is only pushed out
+	vNormal := vxa*cosineAngle + vya*sineAngle
+	if vNormal >= 0 {
+		*ball.Position = [2]float64{newX, newY}
+		return 0
+	}
+
+	vTangent := -vxa*sineAngle + vya*cosineAngle
+	vRadial := -alpha0 * vNormal
+	if peg.Friction > 0 {
+		normalImpulse := -ball.Mass * (1 + alpha0) * vNormal
+		vTangent = applyFriction(ball, vTangent, normalImpulse, peg.Friction)
+	}
+
+	vxNew := vRadial*cosineAngle - vTangent*sineAngle + pvx
+	vyNew := vRadial*sineAngle + vTangent*cosineAngle + pvy
+
+	// The impulse on the ball times the surface velocity, zero for a still peg
+	work := 0.0
+	if pvx != 0 || pvy != 0 {
+		work = ball.Mass * ((vxNew-ball.Velocity[0])*pvx + (vyNew-ball.Velocity[1])*pvy)
+	}
+
+	*ball.Position = [2]float64{newX, newY}
+	*ball.Velocity = [2]float64{vxNew, vyNew}
+	return work
+}
+
+// applyFriction applies the Coulomb friction impulse at the contact point of a
+// rough ball and returns the new tangential velocity. The impulse tries to stop
+// the contact point from slipping, limited to the friction coefficient times the
+// normal impulse, and the same impulse changes the spin of the ball. Only the peg
+// impacts use it, the other contacts are smooth.
+func applyFriction(ball *entities.Particle, vTangent, normalImpulse, friction float64) float64 {
+	slip := vTangent - ball.AngularVelocity*ball.Radius
+
+	compliance := 1 / ball.Mass
+	if ball.Inertia > 0 {
+		compliance += ball.Radius * ball.Radius / ball.Inertia
+	}
+
+	maxImpulse := friction * normalImpulse
+	impulse := math.Max(-maxImpulse, math.Min(maxImpulse, -slip/compliance))
+
+	if ball.Inertia > 0 {
+		ball.AngularVelocity -= ball.Radius * impulse / ball.Inertia
+	}
+
+	return vTangent + impulse/ball.Mass
+}
+
+// ResolveBallCollision separates two overlapping balls and exchanges the normal
+// component of their velocities. A stopped ball does not move, as if its mass
+// were infinite, so the others can pile up on it.
+func (dm *DefaultModel) ResolveBallCollision(ball *entities.Particle, other *entities.Particle) {
+	dx := other.Position[0] - ball.Position[0]
+	dy := other.Position[1] - ball.Position[1]
+	hip := math.Sqrt(dx*dx + dy*dy)
+	if hip == 0 {
+		return
+	}
+
+	nx := dx / hip
+	ny := dy / hip
+	overlap := ball.Radius + other.Radius - hip
+	restitution := ball.Damping * other.Damping
+
+	// Both the overlap and the impulse are shared in proportion to the inverse masses
+	inverseBall := 1 / ball.Mass
+	inverseOther := 1 / other.Mass
+	if other.IsStopped {
+		inverseOther = 0
+	}
+	inverseTotal := inverseBall + inverseOther
+
+	shiftBall := overlap * inverseBall / inverseTotal
+	shiftOther := overlap * inverseOther / inverseTotal
+	*ball.Position = [2]float64{ball.Position[0] - shiftBall*nx, ball.Position[1] - shiftBall*ny}
+	*other.Position = [2]float64{other.Position[0] + shiftOther*nx, other.Position[1] + shiftOther*ny}
+
+	vNormal := (ball.Velocity[0]-other.Velocity[0])*nx + (ball.Velocity[1]-other.Velocity[1])*ny
+	if vNormal <= 0 {
+		return
+	}
+
+	impulse := (1 + restitution) * vNormal / inverseTotal
+	*ball.Velocity = [2]float64{ball.Velocity[0] - impulse*inverseBall*nx, ball.Velocity[1] - impulse*inverseBall*ny}
+	*other.Velocity = [2]float64{other.Velocity[0] + impulse*inverseOther*nx, other.Velocity[1] + impulse*inverseOther*ny}
+}
+
+// ResolveSegmentCollision pushes a ball out of a segment and reflects the normal
+// component of its velocity. A one sided segment also catches balls behind it.
+func (dm *DefaultModel) ResolveSegmentCollision(ball *entities.Particle, segment *entities.Segment) {
+	ex := segment.B[0] - segment.A[0]
+	ey := segment.B[1] - segment.A[1]
+	px := ball.Position[0] - segment.A[0]
+	py := ball.Position[1] - segment.A[1]
+
+	lengthSquare := ex*ex + ey*ey
+	projection := 0.0
+	if lengthSquare > 0 {
+		projection = math.Max(0, math.Min(1, (px*ex+py*ey)/lengthSquare))
+	}
+
+	if segment.OneSided && lengthSquare > 0 && projection > 0 && projection < 1 {
+		// Signed distance to the line, positive on the left side
+		length := math.Sqrt(lengthSquare)
+		nx := -ey / length
+		ny := ex / length
+		distance := px*nx + py*ny
+		if distance < ball.Radius {
+			reflect(ball, nx, ny, ball.Radius-distance, segment.Damping)
+		}
+		return
+	}
+
+	dx := px - projection*ex
+	dy := py - projection*ey
+	distanceSquare := dx*dx + dy*dy
+	if distanceSquare >= ball.Radius*ball.Radius {
+		return
+	}
+
+	if distanceSquare == 0 {
+		// The centre lies on the segment, push the ball back across it to the side it came from
+		nx, ny := 0.0, 1.0
+		if lengthSquare > 0 {
+			length := math.Sqrt(lengthSquare)
+			nx, ny = -ey/length, ex/length
+		}
+		if ball.Velocity[0]*nx+ball.Velocity[1]*ny > 0 {
+			nx, ny = -nx, -ny
+		}
+		reflect(ball, nx, ny, ball.Radius, segment.Damping)
+		return
+	}
+
+	distance := math.Sqrt(distanceSquare)
+	reflect(ball, dx/distance, dy/distance, ball.Radius-distance, segment.Damping)
 }
 
-func dPosition(t float64, position, velocity, acceleration *utils.Point) *utils.Point {
+// ResolvePolygonCollision pushes a ball out of a convex polygon and reflects the
+// normal component of its velocity.
+func (dm *DefaultModel) ResolvePolygonCollision(ball *entities.Particle, polygon *entities.Polygon) {
+	n := len(polygon.Vertices)
+
+	inside := true
+	bestSide := math.Inf(-1)
+	var bestNx, bestNy float64
+
+	closestSquare := math.Inf(1)
+	var closestX, closestY float64
+
+	for i := 0; i < n; i++ {
+		a := polygon.Vertices[i]
+		b := polygon.Vertices[(i+1)%n]
+		ex := b[0] - a[0]
+		ey := b[1] - a[1]
+		px := ball.Position[0] - a[0]
+		py := ball.Position[1] - a[1]
+
+		lengthSquare := ex*ex + ey*ey
+		if lengthSquare == 0 {
+			continue
+		}
+
+		// Outward normal of a counter-clockwise edge
+		length := math.Sqrt(lengthSquare)
+		nx := ey / length
+		ny := -ex / length
+		side := px*nx + py*ny
+		if side > 0 {
+			inside = false
+		}
+		if side > bestSide {
+			bestSide = side
+			bestNx = nx
+			bestNy = ny
+		}
+
+		projection := math.Max(0, math.Min(1, (px*ex+py*ey)/lengthSquare))
+		dx := px - projection*ex
+		dy := py - projection*ey
+		if dx*dx+dy*dy < closestSquare {
+			closestSquare = dx*dx + dy*dy
+			closestX = dx
+			closestY = dy
+		}
+	}
+
+	if inside {
+		// The center is inside the polygon, leave through the closest edge
+		reflect(ball, bestNx, bestNy, ball.Radius-bestSide, polygon.Damping)
+		return
+	}
+
+	if closestSquare >= ball.Radius*ball.Radius {
+		return
+	}
+
+	distance := math.Sqrt(closestSquare)
+	reflect(ball, closestX/distance, closestY/distance, ball.Radius-distance, polygon.Damping)
+}
+
+// reflect moves a ball along the normal by the given depth and bounces it with the
+// product of its restitution and the damping of the obstacle.
+func reflect(ball *entities.Particle, nx, ny, depth, damping float64) {
+	*ball.Position = [2]float64{ball.Position[0] + depth*nx, ball.Position[1] + depth*ny}
+
+	vNormal := ball.Velocity[0]*nx + ball.Velocity[1]*ny
+	if vNormal < 0 {
+		impulse := (1 + ball.Damping*damping) * vNormal
+		*ball.Velocity = [2]float64{ball.Velocity[0] - impulse*nx, ball.Velocity[1] - impulse*ny}
+	}
+}
+
+func dPosition(t float64, position, velocity, acceleration utils.Point, mass float64) utils.Point {
 	return velocity
 }
 
-func dVelocity(t float64, position, velocity, acceleration *utils.Point) *utils.Point {
-	return acceleration
+// dVelocity adds the force fields, evaluated at the stage position and velocity,
+// to the acceleration set by the engine.
+func (dm *DefaultModel) dVelocity(t float64, position, velocity, acceleration utils.Point, mass float64) utils.Point {
+	total := acceleration
+	for _, force := range dm.Forces {
+		a := force.Acceleration(t, position, velocity, mass)
+		total[0] += a[0]
+		total[1] += a[1]
+	}
+
+	return total
 }
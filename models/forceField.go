@@ -0,0 +1,115 @@
+package model
+
+import (
+	"go-galtonboard/utils"
+	"log"
+	"math"
+)
+
+// ForceField is an external field acting on the balls. It returns the acceleration
+// it produces on a ball of the given mass, so it can be evaluated inside every stage
+// of the integrators. The drags and the wind are forces, divided by the mass, while
+// the gradient and the attractor are fields that accelerate every ball alike, as
+// gravity does.
+type ForceField interface {
+	Acceleration(t float64, position, velocity utils.Point, mass float64) utils.Point
+}
+
+// NewForceFields returns the force fields described in the configuration
+func NewForceFields(configs []utils.ForceConfig) []ForceField {
+	fields := make([]ForceField, 0, len(configs))
+
+	for _, config := range configs {
+		switch config.Type {
+		case utils.ForceLinearDrag:
+			fields = append(fields, &LinearDrag{Coefficient: config.Coefficient})
+
+		case utils.ForceQuadraticDrag:
+			fields = append(fields, &QuadraticDrag{Coefficient: config.Coefficient})
+
+		case utils.ForceWind:
+			fields = append(fields, &Wind{Coefficient: config.Coefficient, Velocity: config.Vector})
+
+		case utils.ForceHorizontalGradient:
+			fields = append(fields, &HorizontalGradient{Coefficient: config.Coefficient, Direction: config.Vector, Center: config.Center[0]})
+
+		case utils.ForceCentralAttractor:
+			fields = append(fields, &CentralAttractor{Coefficient: config.Coefficient, Center: config.Center, Softening: config.Softening})
+
+		default:
+			log.Fatal("Invalid force field in the config file. Valid values are: \n" +
+				"\t0: Linear (Stokes) drag\n" +
+				"\t1: Quadratic drag\n" +
+				"\t2: Uniform wind\n" +
+				"\t3: Horizontal gradient\n" +
+				"\t4: Central attractor")
+		}
+	}
+
+	return fields
+}
+
+// LinearDrag is the Stokes drag, a force proportional to the velocity
+type LinearDrag struct {
+	Coefficient float64
+}
+
+func (f *LinearDrag) Acceleration(t float64, position, velocity utils.Point, mass float64) utils.Point {
+	return utils.Point{-f.Coefficient * velocity[0] / mass, -f.Coefficient * velocity[1] / mass}
+}
+
+// QuadraticDrag is the drag at high Reynolds numbers, a force proportional to the squared speed
+type QuadraticDrag struct {
+	Coefficient float64
+}
+
+func (f *QuadraticDrag) Acceleration(t float64, position, velocity utils.Point, mass float64) utils.Point {
+	speed := math.Hypot(velocity[0], velocity[1])
+	return utils.Point{-f.Coefficient * speed * velocity[0] / mass, -f.Coefficient * speed * velocity[1] / mass}
+}
+
+// Wind is a linear drag relative to air moving with a uniform velocity
+type Wind struct {
+	Coefficient float64
+	Velocity    utils.Point
+}
+
+func (f *Wind) Acceleration(t float64, position, velocity utils.Point, mass float64) utils.Point {
+	return utils.Point{
+		f.Coefficient * (f.Velocity[0] - velocity[0]) / mass,
+		f.Coefficient * (f.Velocity[1] - velocity[1]) / mass,
+	}
+}
+
+// HorizontalGradient is a field along a fixed direction whose strength grows
+// linearly with the horizontal distance to a center line
+type HorizontalGradient struct {
+	Coefficient float64
+	Direction   utils.Point
+	Center      float64
+}
+
+func (f *HorizontalGradient) Acceleration(t float64, position, velocity utils.Point, mass float64) utils.Point {
+	strength := f.Coefficient * (position[0] - f.Center)
+	return utils.Point{strength * f.Direction[0], strength * f.Direction[1]}
+}
+
+// CentralAttractor pulls the balls towards a point with an inverse square law,
+// softened to stay finite at the center
+type CentralAttractor struct {
+	Coefficient float64
+	Center      utils.Point
+	Softening   float64
+}
+
+func (f *CentralAttractor) Acceleration(t float64, position, velocity utils.Point, mass float64) utils.Point {
+	dx := f.Center[0] - position[0]
+	dy := f.Center[1] - position[1]
+	distanceSquare := dx*dx + dy*dy + f.Softening*f.Softening
+	if distanceSquare == 0 {
+		return utils.Point{0, 0}
+	}
+
+	strength := f.Coefficient / (distanceSquare * math.Sqrt(distanceSquare))
+	return utils.Point{strength * dx, strength * dy}
+}
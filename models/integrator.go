@@ -0,0 +1,221 @@
+package model
+
+import (
+	"go-galtonboard/entities"
+	"go-galtonboard/utils"
+	"log"
+	"math"
+)
+
+// Integrator advances the balls [start, end) over one time step. It walks the
+// contiguous positions and velocities of the balls and updates them in place,
+// without allocating. Stopped balls are skipped.
+type Integrator interface {
+	Step(balls *entities.Balls, start, end int, t, dt float64)
+}
+
+// NewIntegrator returns the integrator selected in the engine configuration
+func NewIntegrator(config utils.EngineConfig, f1, f2 DiffEq) Integrator {
+	switch config.Integrator {
+	case utils.IntegratorRungeKutta4:
+		return &RungeKutta{f1: f1, f2: f2}
+
+	case utils.IntegratorVelocityVerlet:
+		return &VelocityVerlet{f1: f1, f2: f2}
+
+	case utils.IntegratorSemiImplicitEuler:
+		return &SemiImplicitEuler{f1: f1, f2: f2}
+
+	case utils.IntegratorDormandPrince:
+		tolerance := config.Tolerance
+		if tolerance <= 0 {
+			tolerance = 1e-6
+		}
+		return &DormandPrince{f1: f1, f2: f2, tolerance: tolerance}
+
+	case utils.IntegratorEulerMaruyama:
+		return &EulerMaruyama{f1: f1, f2: f2, langevin: config.Langevin}
+
+	case utils.IntegratorBAOAB:
+		return &BAOAB{f1: f1, f2: f2, langevin: config.Langevin}
+
+	default:
+		log.Fatal("Invalid integrator in the config file. Valid values are: \n" +
+			"\t0: Runge-Kutta 4\n" +
+			"\t1: Velocity Verlet\n" +
+			"\t2: Semi-implicit Euler\n" +
+			"\t3: Dormand-Prince RK45\n" +
+			"\t4: Euler-Maruyama (Langevin)\n" +
+			"\t5: BAOAB (Langevin)")
+	}
+
+	return nil
+}
+
+// Step advances the state with the classical Runge-Kutta 4 scheme
+func (rk *RungeKutta) Step(balls *entities.Balls, start, end int, t, dt float64) {
+	positions, velocities, accelerations := balls.Positions, balls.Velocities, balls.Accelerations
+	for i := start; i < end; i++ {
+		p := balls.Particles[i]
+		if p.IsStopped {
+			continue
+		}
+
+		rk.RungeKutta4(dt, t, &positions[i], &velocities[i], accelerations[i], p.Mass)
+	}
+}
+
+// VelocityVerlet is the second order velocity Verlet scheme
+type VelocityVerlet struct {
+	f1, f2 DiffEq
+}
+
+func (vv *VelocityVerlet) Step(balls *entities.Balls, start, end int, t, dt float64) {
+	positions, velocities, accelerations := balls.Positions, balls.Velocities, balls.Accelerations
+	for i := start; i < end; i++ {
+		p := balls.Particles[i]
+		if p.IsStopped {
+			continue
+		}
+
+		position, velocity, acceleration := positions[i], velocities[i], accelerations[i]
+
+		v0 := vv.f1(t, position, velocity, acceleration, p.Mass)
+		a0 := vv.f2(t, position, velocity, acceleration, p.Mass)
+
+		posT := utils.Point{
+			position[0] + v0[0]*dt + 0.5*a0[0]*dt*dt,
+			position[1] + v0[1]*dt + 0.5*a0[1]*dt*dt,
+		}
+
+		// The new acceleration is evaluated with a predicted velocity, which is exact for position-only forces
+		velP := utils.Point{velocity[0] + a0[0]*dt, velocity[1] + a0[1]*dt}
+		a1 := vv.f2(t+dt, posT, velP, acceleration, p.Mass)
+
+		positions[i] = posT
+		velocities[i] = utils.Point{
+			velocity[0] + 0.5*(a0[0]+a1[0])*dt,
+			velocity[1] + 0.5*(a0[1]+a1[1])*dt,
+		}
+	}
+}
+
+// SemiImplicitEuler is the first order symplectic Euler scheme
+type SemiImplicitEuler struct {
+	f1, f2 DiffEq
+}
+
+func (se *SemiImplicitEuler) Step(balls *entities.Balls, start, end int, t, dt float64) {
+	positions, velocities, accelerations := balls.Positions, balls.Velocities, balls.Accelerations
+	for i := start; i < end; i++ {
+		p := balls.Particles[i]
+		if p.IsStopped {
+			continue
+		}
+
+		position, velocity, acceleration := positions[i], velocities[i], accelerations[i]
+
+		a0 := se.f2(t, position, velocity, acceleration, p.Mass)
+		velT := utils.Point{velocity[0] + a0[0]*dt, velocity[1] + a0[1]*dt}
+
+		v1 := se.f1(t, position, velT, acceleration, p.Mass)
+		positions[i] = utils.Point{position[0] + v1[0]*dt, position[1] + v1[1]*dt}
+		velocities[i] = velT
+	}
+}
+
+// DormandPrince is the adaptive Dormand-Prince RK45 scheme. Each step is split
+// into as many internal steps as needed to keep the local error under the tolerance.
+type DormandPrince struct {
+	f1, f2    DiffEq
+	tolerance float64
+}
+
+var (
+	dpC = [7]float64{0, 1.0 / 5.0, 3.0 / 10.0, 4.0 / 5.0, 8.0 / 9.0, 1, 1}
+	dpA = [7][6]float64{
+		{},
+		{1.0 / 5.0},
+		{3.0 / 40.0, 9.0 / 40.0},
+		{44.0 / 45.0, -56.0 / 15.0, 32.0 / 9.0},
+		{19372.0 / 6561.0, -25360.0 / 2187.0, 64448.0 / 6561.0, -212.0 / 729.0},
+		{9017.0 / 3168.0, -355.0 / 33.0, 46732.0 / 5247.0, 49.0 / 176.0, -5103.0 / 18656.0},
+		{35.0 / 384.0, 0, 500.0 / 1113.0, 125.0 / 192.0, -2187.0 / 6784.0, 11.0 / 84.0},
+	}
+	dpB5 = [7]float64{35.0 / 384.0, 0, 500.0 / 1113.0, 125.0 / 192.0, -2187.0 / 6784.0, 11.0 / 84.0, 0}
+	dpB4 = [7]float64{5179.0 / 57600.0, 0, 7571.0 / 16695.0, 393.0 / 640.0, -92097.0 / 339200.0, 187.0 / 2100.0, 1.0 / 40.0}
+)
+
+func (dp *DormandPrince) Step(balls *entities.Balls, start, end int, t, dt float64) {
+	for i := start; i < end; i++ {
+		p := balls.Particles[i]
+		if p.IsStopped {
+			continue
+		}
+
+		balls.Positions[i], balls.Velocities[i] = dp.step(balls.Positions[i], balls.Velocities[i], balls.Accelerations[i], p.Mass, t, dt)
+	}
+}
+
+// step advances a single state, with as many internal steps as the tolerance needs.
+func (dp *DormandPrince) step(pos, vel, acceleration utils.Point, mass, t, dt float64) (utils.Point, utils.Point) {
+
+	elapsed := 0.0
+	h := dt
+	for elapsed < dt {
+		if elapsed+h > dt {
+			h = dt - elapsed
+		}
+
+		var kx, kv [7]utils.Point
+		for i := 0; i < 7; i++ {
+			posI := pos
+			velI := vel
+			for j := 0; j < i; j++ {
+				posI[0] += h * dpA[i][j] * kx[j][0]
+				posI[1] += h * dpA[i][j] * kx[j][1]
+				velI[0] += h * dpA[i][j] * kv[j][0]
+				velI[1] += h * dpA[i][j] * kv[j][1]
+			}
+
+			kx[i] = dp.f1(t+elapsed+dpC[i]*h, posI, velI, acceleration, mass)
+			kv[i] = dp.f2(t+elapsed+dpC[i]*h, posI, velI, acceleration, mass)
+		}
+
+		posT := pos
+		velT := vel
+		var posErr, velErr utils.Point
+		for i := 0; i < 7; i++ {
+			posT[0] += h * dpB5[i] * kx[i][0]
+			posT[1] += h * dpB5[i] * kx[i][1]
+			velT[0] += h * dpB5[i] * kv[i][0]
+			velT[1] += h * dpB5[i] * kv[i][1]
+
+			posErr[0] += h * (dpB5[i] - dpB4[i]) * kx[i][0]
+			posErr[1] += h * (dpB5[i] - dpB4[i]) * kx[i][1]
+			velErr[0] += h * (dpB5[i] - dpB4[i]) * kv[i][0]
+			velErr[1] += h * (dpB5[i] - dpB4[i]) * kv[i][1]
+		}
+
+		// Mixed absolute and relative error, normalized so that 1 is the tolerance
+		err := 0.0
+		for i := 0; i < 2; i++ {
+			err = math.Max(err, math.Abs(posErr[i])/(dp.tolerance*(1+math.Abs(posT[i]))))
+			err = math.Max(err, math.Abs(velErr[i])/(dp.tolerance*(1+math.Abs(velT[i]))))
+		}
+
+		if err <= 1 || h <= dt*1e-6 {
+			pos = posT
+			vel = velT
+			elapsed += h
+		}
+
+		factor := 5.0
+		if err > 0 {
+			factor = math.Min(5, math.Max(0.2, 0.9*math.Pow(err, -0.2)))
+		}
+		h = math.Max(h*factor, dt*1e-6)
+	}
+
+	return pos, vel
+}
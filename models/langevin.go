@@ -0,0 +1,84 @@
+package model
+
+import (
+	"go-galtonboard/entities"
+	"go-galtonboard/utils"
+	"math"
+)
+
+// IsStochastic tells whether an integrator couples the balls to a thermal bath
+func IsStochastic(integrator int) bool {
+	return integrator == utils.IntegratorEulerMaruyama || integrator == utils.IntegratorBAOAB
+}
+
+// EulerMaruyama integrates the Langevin equation with the Euler-Maruyama scheme.
+// The velocity gets the friction and a Gaussian kick, and the position is moved
+// with the new velocity.
+type EulerMaruyama struct {
+	f1, f2   DiffEq
+	langevin utils.LangevinConfig
+}
+
+func (em *EulerMaruyama) Step(balls *entities.Balls, start, end int, t, dt float64) {
+	positions, velocities, accelerations := balls.Positions, balls.Velocities, balls.Accelerations
+	gamma := em.langevin.Friction
+	for i := start; i < end; i++ {
+		p := balls.Particles[i]
+		if p.IsStopped {
+			continue
+		}
+
+		position, velocity, acceleration := positions[i], velocities[i], accelerations[i]
+
+		sigma := math.Sqrt(2 * gamma * em.langevin.Temperature * dt / p.Mass)
+		a0 := em.f2(t, position, velocity, acceleration, p.Mass)
+
+		velT := utils.Point{
+			velocity[0] + (a0[0]-gamma*velocity[0])*dt + sigma*p.Noise.NormFloat64(),
+			velocity[1] + (a0[1]-gamma*velocity[1])*dt + sigma*p.Noise.NormFloat64(),
+		}
+
+		v1 := em.f1(t, position, velT, acceleration, p.Mass)
+		positions[i] = utils.Point{position[0] + v1[0]*dt, position[1] + v1[1]*dt}
+		velocities[i] = velT
+	}
+}
+
+// BAOAB integrates the Langevin equation with the BAOAB splitting: half kicks from
+// the forces (B), half drifts (A) and an exact Ornstein-Uhlenbeck step for the
+// friction and the noise (O) in the middle.
+type BAOAB struct {
+	f1, f2   DiffEq
+	langevin utils.LangevinConfig
+}
+
+func (bo *BAOAB) Step(balls *entities.Balls, start, end int, t, dt float64) {
+	c1 := math.Exp(-bo.langevin.Friction * dt)
+	for i := start; i < end; i++ {
+		p := balls.Particles[i]
+		if p.IsStopped {
+			continue
+		}
+
+		pos, vel, acceleration := balls.Positions[i], balls.Velocities[i], balls.Accelerations[i]
+		c2 := math.Sqrt((1 - c1*c1) * bo.langevin.Temperature / p.Mass)
+
+		a0 := bo.f2(t, pos, vel, acceleration, p.Mass)
+		vel = utils.Point{vel[0] + 0.5*dt*a0[0], vel[1] + 0.5*dt*a0[1]}
+
+		v0 := bo.f1(t, pos, vel, acceleration, p.Mass)
+		pos = utils.Point{pos[0] + 0.5*dt*v0[0], pos[1] + 0.5*dt*v0[1]}
+
+		vel = utils.Point{
+			c1*vel[0] + c2*p.Noise.NormFloat64(),
+			c1*vel[1] + c2*p.Noise.NormFloat64(),
+		}
+
+		v1 := bo.f1(t+0.5*dt, pos, vel, acceleration, p.Mass)
+		pos = utils.Point{pos[0] + 0.5*dt*v1[0], pos[1] + 0.5*dt*v1[1]}
+
+		a1 := bo.f2(t+dt, pos, vel, acceleration, p.Mass)
+		balls.Positions[i] = pos
+		balls.Velocities[i] = utils.Point{vel[0] + 0.5*dt*a1[0], vel[1] + 0.5*dt*a1[1]}
+	}
+}
@@ -6,7 +6,12 @@ import (
 )
 
 type PhysicsModel interface {
-	UpdateBall(particle *entities.Particle, t, dt float64)
+	UpdateBalls(balls *entities.Balls, start, end int, t, dt float64)
 	UpdatePeg(particle *entities.Particle, t, dt float64, displacement *utils.PegDisplacement)
-	ResolveCollision(particle *entities.Particle, peg *entities.Particle)
+	PlacePeg(particle *entities.Particle, displacement *utils.PegDisplacement)
+	BreathePeg(particle *entities.Particle, t, dt float64, breathing *utils.BreathingConfig)
+	ResolveCollision(particle *entities.Particle, peg *entities.Particle) float64
+	ResolveBallCollision(particle *entities.Particle, other *entities.Particle)
+	ResolveSegmentCollision(particle *entities.Particle, segment *entities.Segment)
+	ResolvePolygonCollision(particle *entities.Particle, polygon *entities.Polygon)
 }
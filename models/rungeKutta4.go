@@ -4,39 +4,42 @@ import (
 	"go-galtonboard/utils"
 )
 
-type RungeState struct {
-	Position *utils.Point
-	Velocity *utils.Point
-}
-
-type DiffEq func(t float64, position, velocity, acceleration *utils.Point) *utils.Point
+// DiffEq is the derivative of the position or the velocity of a ball of the given
+// mass. The points are passed by value so the stages of the integrators stay on the stack.
+type DiffEq func(t float64, position, velocity, acceleration utils.Point, mass float64) utils.Point
 
 type RungeKutta struct {
 	f1, f2 DiffEq
 }
 
-func (rk *RungeKutta) RungeKutta4(dt, t float64, position, velocity, acceleration *utils.Point) RungeState {
-	var (
-		k11, k21, k12, k22, k13, k23, k14, k24 *utils.Point
-	)
-
-	k11 = utils.Mul(rk.f1(t, position, velocity, acceleration), dt)
-	k21 = utils.Mul(rk.f2(t, position, velocity, acceleration), dt)
+// RungeKutta4 advances the position and velocity in place.
+func (rk *RungeKutta) RungeKutta4(dt, t float64, position, velocity *utils.Point, acceleration utils.Point, mass float64) {
+	var k11, k21, k12, k22, k13, k23, k14, k24 utils.Point
 
-	k12 = utils.Mul(rk.f1(t+dt/2.0, utils.Add(position, utils.Mul(k11, 0.5)), utils.Add(velocity, utils.Mul(k21, 0.5)), acceleration), dt)
-	k22 = utils.Mul(rk.f2(t+dt/2.0, utils.Add(position, utils.Mul(k11, 0.5)), utils.Add(velocity, utils.Mul(k21, 0.5)), acceleration), dt)
+	k11 = scale(rk.f1(t, *position, *velocity, acceleration, mass), dt)
+	k21 = scale(rk.f2(t, *position, *velocity, acceleration, mass), dt)
 
-	k13 = utils.Mul(rk.f1(t+dt/2.0, utils.Add(position, utils.Mul(k12, 0.5)), utils.Add(velocity, utils.Mul(k22, 0.5)), acceleration), dt)
-	k23 = utils.Mul(rk.f2(t+dt/2.0, utils.Add(position, utils.Mul(k12, 0.5)), utils.Add(velocity, utils.Mul(k22, 0.5)), acceleration), dt)
+	p2 := utils.Point{position[0] + k11[0]*0.5, position[1] + k11[1]*0.5}
+	v2 := utils.Point{velocity[0] + k21[0]*0.5, velocity[1] + k21[1]*0.5}
+	k12 = scale(rk.f1(t+dt/2.0, p2, v2, acceleration, mass), dt)
+	k22 = scale(rk.f2(t+dt/2.0, p2, v2, acceleration, mass), dt)
 
-	k14 = utils.Mul(rk.f1(t+dt, utils.Add(position, k13), utils.Add(velocity, k23), acceleration), dt)
-	k24 = utils.Mul(rk.f2(t+dt, utils.Add(position, k13), utils.Add(velocity, k23), acceleration), dt)
+	p3 := utils.Point{position[0] + k12[0]*0.5, position[1] + k12[1]*0.5}
+	v3 := utils.Point{velocity[0] + k22[0]*0.5, velocity[1] + k22[1]*0.5}
+	k13 = scale(rk.f1(t+dt/2.0, p3, v3, acceleration, mass), dt)
+	k23 = scale(rk.f2(t+dt/2.0, p3, v3, acceleration, mass), dt)
 
-	posT := utils.Add(position, utils.Mul(utils.Add(utils.Add(k11, utils.Mul(k12, 2.0)), utils.Add(utils.Mul(k13, 2.0), k14)), 1.0/6.0))
-	velT := utils.Add(velocity, utils.Mul(utils.Add(utils.Add(k21, utils.Mul(k22, 2.0)), utils.Add(utils.Mul(k23, 2.0), k24)), 1.0/6.0))
+	p4 := utils.Point{position[0] + k13[0], position[1] + k13[1]}
+	v4 := utils.Point{velocity[0] + k23[0], velocity[1] + k23[1]}
+	k14 = scale(rk.f1(t+dt, p4, v4, acceleration, mass), dt)
+	k24 = scale(rk.f2(t+dt, p4, v4, acceleration, mass), dt)
 
-	return RungeState{
-		Position: posT,
-		Velocity: velT,
+	for i := 0; i < 2; i++ {
+		position[i] += ((k11[i] + k12[i]*2.0) + (k13[i]*2.0 + k14[i])) * (1.0 / 6.0)
+		velocity[i] += ((k21[i] + k22[i]*2.0) + (k23[i]*2.0 + k24[i])) * (1.0 / 6.0)
 	}
 }
+
+func scale(p utils.Point, scalar float64) utils.Point {
+	return utils.Point{p[0] * scalar, p[1] * scalar}
+}
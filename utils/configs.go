@@ -3,7 +3,10 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 )
 
 // Particles types
@@ -28,36 +31,294 @@ const (
 
 	SphericDist
 	SphericGaussianDist
+
+	ExpressionDist
+	ImageDist
+)
+
+// RadiusVariables are the variables available in the radius expressions
+var RadiusVariables = []string{"x", "y", "row", "col", "xMiddle", "yMiddle", "MinRadius", "MaxRadius"}
+
+// Interpolation modes of the radius images
+const (
+	InterpolationNearest = iota
+	InterpolationBilinear
+)
+
+// Displacement modes
+const (
+	DisplacementUniform = iota
+	DisplacementTravelingWave
+	DisplacementStandingWave
+	DisplacementRandomPhase
+	DisplacementNoise
+	DisplacementSchedule
+)
+
+// Lattices types
+const (
+	LatticeStaggered = iota
+	LatticeSquare
+	LatticeTriangular
+	LatticeHoneycomb
+	LatticeRandom
+	LatticePoissonDisk
+)
+
+// Integrators types
+const (
+	IntegratorRungeKutta4 = iota
+	IntegratorVelocityVerlet
+	IntegratorSemiImplicitEuler
+	IntegratorDormandPrince
+	IntegratorEulerMaruyama
+	IntegratorBAOAB
+)
+
+// Obstacles types
+const (
+	ObstacleSegment = iota
+	ObstaclePolygon
+)
+
+// Engine modes
+const (
+	EngineTimeStepped = iota
+	EngineEventDriven
+)
+
+// Force fields types
+const (
+	ForceLinearDrag = iota
+	ForceQuadraticDrag
+	ForceWind
+	ForceHorizontalGradient
+	ForceCentralAttractor
 )
 
 // ParticleConfig represents the configuration of the particles
 type ParticleConfig struct {
+	NParticles    int
+	Radius        float64
+	InitDeltaX    float64
+	InitDeltaY    float64
+	InitDeltaVx   float64
+	InitDeltaVy   float64
+	InertiaFactor float64
+	Species       []SpeciesConfig
+}
+
+// SpeciesConfig represents one population of particles. A Mass or a Restitution left
+// out, or not positive, is 1, so the impacts of the species use the damping of the
+// pegs, of the obstacles and of the other ball alone.
+type SpeciesConfig struct {
 	NParticles  int
-	Radius      float64
-	InitDeltaX  float64
-	InitDeltaY  float64
-	InitDeltaVx float64
-	InitDeltaVy float64
+	MinRadius   float64
+	MaxRadius   float64
+	Mass        float64
+	Restitution float64
+	Color       string
+}
+
+// SpeciesList returns the configured species, with their defaults filled in. Without
+// species, the particles form a single population built from NParticles and Radius.
+func (c ParticleConfig) SpeciesList() []SpeciesConfig {
+	if len(c.Species) > 0 {
+		species := make([]SpeciesConfig, len(c.Species))
+		for i, s := range c.Species {
+			if s.Mass <= 0 {
+				s.Mass = 1
+			}
+			if s.Restitution <= 0 {
+				s.Restitution = 1
+			}
+			species[i] = s
+		}
+
+		return species
+	}
+
+	return []SpeciesConfig{
+		{
+			NParticles:  c.NParticles,
+			MinRadius:   c.Radius,
+			MaxRadius:   c.Radius,
+			Mass:        1,
+			Restitution: 1,
+		},
+	}
+}
+
+// TotalParticles returns the number of particles of every species
+func (c ParticleConfig) TotalParticles() int {
+	total := 0
+	for _, species := range c.SpeciesList() {
+		total += species.NParticles
+	}
+
+	return total
 }
 
-// PegDisplacement represents the displacement of the pegs
+// PegDisplacement represents the displacement of the pegs. The phase of every peg is
+// PhaseRow·row + PhaseColumn·col in the wave modes, and the noise adds NModes cosines
+// with frequencies spread between FrequencyMin and FrequencyMax.
 type PegDisplacement struct {
 	Displacement bool
 	AmplitudeX   float64
 	AmplitudeY   float64
 	FrequencyX   float64
 	FrequencyY   float64
+
+	Mode         int
+	PhaseRow     float64
+	PhaseColumn  float64
+	NModes       int
+	FrequencyMin float64
+	FrequencyMax float64
+	ScheduleFile string
+	Loop         bool
+
+	schedule *Schedule
+}
+
+// LoadSchedule reads the displacement schedule, with a path relative to the given route.
+func (d *PegDisplacement) LoadSchedule(route string) error {
+	fileName := d.ScheduleFile
+	if !filepath.IsAbs(fileName) {
+		fileName = route + fileName
+	}
+
+	schedule, err := LoadSchedule(fileName)
+	if err != nil {
+		return err
+	}
+
+	d.schedule = schedule
+	return nil
+}
+
+// Schedule returns the schedule loaded with LoadSchedule.
+func (d *PegDisplacement) Schedule() *Schedule {
+	return d.schedule
+}
+
+// Reach returns the largest distance a peg can move away from its rest position.
+func (d *PegDisplacement) Reach() float64 {
+	if !d.Displacement {
+		return 0
+	}
+
+	switch d.Mode {
+	case DisplacementNoise:
+		// The sum of NModes cosines scaled by 1/sqrt(NModes)
+		return math.Hypot(d.AmplitudeX, d.AmplitudeY) * math.Sqrt(math.Max(float64(d.NModes), 1))
+
+	case DisplacementSchedule:
+		reach := 0.0
+		if d.schedule != nil {
+			for i := range d.schedule.Times {
+				reach = math.Max(reach, math.Hypot(d.schedule.X[i], d.schedule.Y[i]))
+			}
+		}
+		return reach
+
+	default:
+		return math.Hypot(d.AmplitudeX, d.AmplitudeY)
+	}
+}
+
+// DisorderConfig represents the quenched disorder of the pegs. Jitter is the standard
+// deviation of the Gaussian shift of every peg and Vacancy the probability of removing it.
+type DisorderConfig struct {
+	Jitter       float64
+	Vacancy      float64
+	Realisations int
+	Export       bool
+}
+
+// BreathingConfig represents pegs whose radius oscillates around the radius of their
+// distribution, with an amplitude scaled by the profile of the Envelope distribution.
+type BreathingConfig struct {
+	Enabled     bool
+	Amplitude   float64
+	Frequency   float64
+	PhaseRow    float64
+	PhaseColumn float64
+	Envelope    int
 }
 
 // PegConfig represents the configuration of the pegs
 type PegConfig struct {
-	MinRadius    float64
-	MaxRadius    float64
+	MinRadius     float64
+	MaxRadius     float64
+	Damping       float64
+	Friction      float64
+	Distribution  int
+	DeltaFactor   float64
+	CenterFactor  int
+	Displacement  PegDisplacement
+	Disorder      DisorderConfig
+	Breathing     BreathingConfig
+	Expression    string
+	RadiusImage   string
+	Interpolation int
+
+	expression  *Expression
+	radiusImage *GrayImage
+}
+
+// RadiusExpression returns the parsed radius expression of the expression distribution.
+func (c *PegConfig) RadiusExpression() (*Expression, error) {
+	if c.expression == nil || c.expression.Source != c.Expression {
+		expression, err := ParseExpression(c.Expression, RadiusVariables)
+		if err != nil {
+			return nil, err
+		}
+		c.expression = expression
+	}
+
+	return c.expression, nil
+}
+
+// LoadRadiusImage reads the radius image of the image distribution, with a path
+// relative to the given route.
+func (c *PegConfig) LoadRadiusImage(route string) error {
+	fileName := c.RadiusImage
+	if !filepath.IsAbs(fileName) {
+		fileName = route + fileName
+	}
+
+	image, err := LoadGrayImage(fileName)
+	if err != nil {
+		return err
+	}
+
+	c.radiusImage = image
+	return nil
+}
+
+// RadiusMap returns the radius image loaded with LoadRadiusImage.
+func (c *PegConfig) RadiusMap() *GrayImage {
+	return c.radiusImage
+}
+
+// BinConfig represents the collection tray below the last row of pegs
+type BinConfig struct {
+	Enabled      bool
+	WallHeight   float64
+	WallWidth    float64
 	Damping      float64
-	Distribution int
-	DeltaFactor  float64
-	CenterFactor int
-	Displacement PegDisplacement
+	RestVelocity float64
+	RestSteps    int
+}
+
+// ObstacleConfig represents a static obstacle. Segments join consecutive points
+// into a polyline, polygons must be convex.
+type ObstacleConfig struct {
+	Type     int
+	Points   [][2]float64
+	Damping  float64
+	OneSided bool
 }
 
 // BoardConfig represents the configuration of the board
@@ -68,22 +329,55 @@ type BoardConfig struct {
 	NCols               int
 	Periodic            bool
 	StartHeightParticle float64
+	Bins                BinConfig
+	SolidBorder         bool
+	Obstacles           []ObstacleConfig
+	GeometryFile        string
+	Lattice             int
+	LatticeAngle        float64
+	MinSeparation       float64
+	CellSize            float64
+}
+
+// ForceConfig represents an external force field acting on the balls
+type ForceConfig struct {
+	Type        int
+	Coefficient float64
+	Vector      [2]float64
+	Center      [2]float64
+	Softening   float64
+}
+
+// LangevinConfig represents the thermal bath used by the stochastic integrators
+type LangevinConfig struct {
+	Temperature float64
+	Friction    float64
 }
 
 // EngineConfig represents the configuration of the logic
 type EngineConfig struct {
-	SubSteps    int
-	MaxSteps    int
-	Dt          float64
-	ThreadCount int
-	CPUCount    int
-	Gravity     [2]float64
+	SubSteps             int
+	MaxSteps             int
+	Dt                   float64
+	ThreadCount          int
+	CPUCount             int
+	Gravity              [2]float64
+	BallCollisions       bool
+	Seed                 uint64
+	Integrator           int
+	Tolerance            float64
+	ContinuousCollisions bool
+	Mode                 int
+	Forces               []ForceConfig
+	Langevin             LangevinConfig
 }
 
 // SaveConfig represents the configuration of the save
 type SaveConfig struct {
-	SavePaths     bool
-	SaveHistogram bool
+	SavePaths          bool
+	SaveHistogram      bool
+	SaveEnergy         bool
+	CheckpointInterval int
 }
 
 // Configs represents the configuration of the simulation
@@ -111,6 +405,38 @@ func LoadConfig(route string) (*Configs, error) {
 		return nil, errors.New("error decoding the configuration file")
 	}
 
+	// The breathing envelope reuses the distributions
+	usesDistribution := func(distribution int) bool {
+		breathing := config.PegConfig.Breathing
+		return config.PegConfig.Distribution == distribution || (breathing.Enabled && breathing.Envelope == distribution)
+	}
+
+	if usesDistribution(ExpressionDist) {
+		_, err = config.PegConfig.RadiusExpression()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the radius expression: %v", err)
+		}
+	}
+
+	displacement := &config.PegConfig.Displacement
+	if displacement.Displacement && displacement.Mode == DisplacementSchedule {
+		err = displacement.LoadSchedule(route)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if usesDistribution(ImageDist) {
+		err = config.PegConfig.LoadRadiusImage(route)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.PegConfig.Interpolation != InterpolationNearest && config.PegConfig.Interpolation != InterpolationBilinear {
+			return nil, errors.New("invalid interpolation, valid values are 0 (nearest) and 1 (bilinear)")
+		}
+	}
+
 	return &config, nil
 }
 
@@ -128,17 +454,20 @@ func CreateBaseConfig(route string) error {
 
 	config := Configs{
 		ParticleConfig: ParticleConfig{
-			NParticles:  100,
-			Radius:      1,
-			InitDeltaX:  0.5,
-			InitDeltaY:  0,
-			InitDeltaVx: 1,
-			InitDeltaVy: 0,
+			NParticles:    100,
+			Radius:        1,
+			InitDeltaX:    0.5,
+			InitDeltaY:    0,
+			InitDeltaVx:   1,
+			InitDeltaVy:   0,
+			InertiaFactor: 0.4,
+			Species:       []SpeciesConfig{},
 		},
 		PegConfig: PegConfig{
 			MinRadius:    7,
 			MaxRadius:    7,
 			Damping:      0.5,
+			Friction:     0,
 			DeltaFactor:  0.1,
 			CenterFactor: 0,
 			Distribution: PegUniformDist,
@@ -148,7 +477,32 @@ func CreateBaseConfig(route string) error {
 				AmplitudeY:   0,
 				FrequencyX:   0,
 				FrequencyY:   0,
+				Mode:         DisplacementUniform,
+				PhaseRow:     0,
+				PhaseColumn:  0,
+				NModes:       8,
+				FrequencyMin: 1,
+				FrequencyMax: 10,
+				ScheduleFile: "schedule.csv",
+				Loop:         true,
+			},
+			Disorder: DisorderConfig{
+				Jitter:       0,
+				Vacancy:      0,
+				Realisations: 1,
+				Export:       false,
+			},
+			Breathing: BreathingConfig{
+				Enabled:     false,
+				Amplitude:   1,
+				Frequency:   10,
+				PhaseRow:    0,
+				PhaseColumn: 0,
+				Envelope:    PegUniformDist,
 			},
+			Expression:    "MinRadius + (MaxRadius - MinRadius) * exp(-((x - xMiddle) / 100)^2)",
+			RadiusImage:   "radius.png",
+			Interpolation: InterpolationBilinear,
 		},
 		BoardConfig: BoardConfig{
 			VerticalSpace:       20,
@@ -157,18 +511,46 @@ func CreateBaseConfig(route string) error {
 			NCols:               25,
 			Periodic:            false,
 			StartHeightParticle: 20,
+			Bins: BinConfig{
+				Enabled:      false,
+				WallHeight:   40,
+				WallWidth:    1,
+				Damping:      0.3,
+				RestVelocity: 0.5,
+				RestSteps:    20,
+			},
+			SolidBorder:   false,
+			Obstacles:     []ObstacleConfig{},
+			GeometryFile:  "",
+			Lattice:       LatticeStaggered,
+			LatticeAngle:  60,
+			MinSeparation: 20,
+			CellSize:      0,
 		},
 		EngineConfig: EngineConfig{
-			SubSteps:    2,
-			MaxSteps:    10000,
-			Dt:          0.03,
-			ThreadCount: 1,
-			CPUCount:    1,
-			Gravity:     [2]float64{0, -9.8},
+			SubSteps:             2,
+			MaxSteps:             10000,
+			Dt:                   0.03,
+			ThreadCount:          1,
+			CPUCount:             1,
+			Gravity:              [2]float64{0, -9.8},
+			BallCollisions:       false,
+			Seed:                 0,
+			Integrator:           IntegratorRungeKutta4,
+			Tolerance:            1e-6,
+			ContinuousCollisions: false,
+			Mode:                 EngineTimeStepped,
+			Forces:               []ForceConfig{},
+			Langevin: LangevinConfig{
+				Temperature: 0,
+				Friction:    0,
+			},
 		},
 		SaveConfig: SaveConfig{
-			SavePaths:     true,
-			SaveHistogram: true,
+			SavePaths:          true,
+			SaveHistogram:      true,
+			SaveEnergy:         false,
+			CheckpointInterval: 0,
 		},
 	}
 
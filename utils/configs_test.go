@@ -0,0 +1,25 @@
+package utils
+
+import "testing"
+
+func TestSpeciesListDefaults(t *testing.T) {
+	config := ParticleConfig{
+		Species: []SpeciesConfig{
+			{NParticles: 10, MinRadius: 1, MaxRadius: 1},
+			{NParticles: 5, MinRadius: 2, MaxRadius: 3, Mass: 4, Restitution: 0.5},
+		},
+	}
+
+	species := config.SpeciesList()
+	if species[0].Mass != 1 || species[0].Restitution != 1 {
+		t.Errorf("got mass %v and restitution %v for a species without them, want 1 and 1", species[0].Mass, species[0].Restitution)
+	}
+
+	if species[1].Mass != 4 || species[1].Restitution != 0.5 {
+		t.Errorf("got mass %v and restitution %v, want 4 and 0.5", species[1].Mass, species[1].Restitution)
+	}
+
+	if config.Species[0].Restitution != 0 {
+		t.Error("the defaults were written back to the configuration")
+	}
+}
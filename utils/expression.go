@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// Expression represents a parsed arithmetic formula. It supports + - * / % ^,
+// parentheses, the constants pi and e and the functions in expressionFunctions.
+type Expression struct {
+	Source    string
+	Variables []string
+	evaluate  func(values []float64) float64
+}
+
+// expressionFunctions lists the functions available in the expressions by arity.
+var expressionFunctions = map[string]interface{}{
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"exp":   math.Exp,
+	"log":   math.Log,
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"tanh":  math.Tanh,
+	"min":   math.Min,
+	"max":   math.Max,
+	"pow":   math.Pow,
+	"atan2": math.Atan2,
+	"mod":   math.Mod,
+}
+
+var expressionConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// ParseExpression parses the source into an expression of the given variables. The
+// values passed to Evaluate follow the same order as the variables.
+func ParseExpression(source string, variables []string) (*Expression, error) {
+	p := &expressionParser{source: []rune(source), variables: variables}
+
+	evaluate, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.position < len(p.source) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.source[p.position], p.position+1)
+	}
+
+	return &Expression{Source: source, Variables: variables, evaluate: evaluate}, nil
+}
+
+// Evaluate returns the value of the expression for the given values of the variables.
+func (e *Expression) Evaluate(values ...float64) float64 {
+	return e.evaluate(values)
+}
+
+type expressionParser struct {
+	source    []rune
+	position  int
+	variables []string
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.position < len(p.source) && unicode.IsSpace(p.source[p.position]) {
+		p.position++
+	}
+}
+
+// accept consumes the next character when it is the given one.
+func (p *expressionParser) accept(r rune) bool {
+	p.skipSpaces()
+	if p.position < len(p.source) && p.source[p.position] == r {
+		p.position++
+		return true
+	}
+
+	return false
+}
+
+// parseSum parses terms joined by + and -.
+func (p *expressionParser) parseSum() (func([]float64) float64, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var operator rune
+		if p.accept('+') {
+			operator = '+'
+		} else if p.accept('-') {
+			operator = '-'
+		} else {
+			return left, nil
+		}
+
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+
+		a, b := left, right
+		if operator == '+' {
+			left = func(v []float64) float64 { return a(v) + b(v) }
+		} else {
+			left = func(v []float64) float64 { return a(v) - b(v) }
+		}
+	}
+}
+
+// parseProduct parses factors joined by *, / and %.
+func (p *expressionParser) parseProduct() (func([]float64) float64, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var operator rune
+		if p.accept('*') {
+			operator = '*'
+		} else if p.accept('/') {
+			operator = '/'
+		} else if p.accept('%') {
+			operator = '%'
+		} else {
+			return left, nil
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		a, b := left, right
+		switch operator {
+		case '*':
+			left = func(v []float64) float64 { return a(v) * b(v) }
+		case '/':
+			left = func(v []float64) float64 { return a(v) / b(v) }
+		default:
+			left = func(v []float64) float64 { return math.Mod(a(v), b(v)) }
+		}
+	}
+}
+
+// parseUnary parses a signed power, so -x^2 is -(x^2).
+func (p *expressionParser) parseUnary() (func([]float64) float64, error) {
+	if p.accept('-') {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v []float64) float64 { return -operand(v) }, nil
+	}
+
+	if p.accept('+') {
+		return p.parseUnary()
+	}
+
+	return p.parsePower()
+}
+
+// parsePower parses a right associative power.
+func (p *expressionParser) parsePower() (func([]float64) float64, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.accept('^') {
+		return base, nil
+	}
+
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v []float64) float64 { return math.Pow(base(v), exponent(v)) }, nil
+}
+
+func (p *expressionParser) parsePrimary() (func([]float64) float64, error) {
+	p.skipSpaces()
+	if p.position >= len(p.source) {
+		return nil, fmt.Errorf("unexpected end of the expression")
+	}
+
+	if p.accept('(') {
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ')' at position %d", p.position+1)
+		}
+		return inner, nil
+	}
+
+	r := p.source[p.position]
+	if unicode.IsDigit(r) || r == '.' {
+		return p.parseNumber()
+	}
+
+	if unicode.IsLetter(r) || r == '_' {
+		return p.parseIdentifier()
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", r, p.position+1)
+}
+
+func (p *expressionParser) parseNumber() (func([]float64) float64, error) {
+	start := p.position
+	for p.position < len(p.source) && (unicode.IsDigit(p.source[p.position]) || p.source[p.position] == '.') {
+		p.position++
+	}
+
+	// Exponent, as in 1.5e-3
+	if p.position < len(p.source) && (p.source[p.position] == 'e' || p.source[p.position] == 'E') {
+		next := p.position + 1
+		if next < len(p.source) && (p.source[next] == '+' || p.source[next] == '-') {
+			next++
+		}
+		if next < len(p.source) && unicode.IsDigit(p.source[next]) {
+			p.position = next
+			for p.position < len(p.source) && unicode.IsDigit(p.source[p.position]) {
+				p.position++
+			}
+		}
+	}
+
+	value, err := strconv.ParseFloat(string(p.source[start:p.position]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q at position %d", string(p.source[start:p.position]), start+1)
+	}
+
+	return func([]float64) float64 { return value }, nil
+}
+
+func (p *expressionParser) parseIdentifier() (func([]float64) float64, error) {
+	start := p.position
+	for p.position < len(p.source) && (unicode.IsLetter(p.source[p.position]) || unicode.IsDigit(p.source[p.position]) || p.source[p.position] == '_') {
+		p.position++
+	}
+	name := string(p.source[start:p.position])
+
+	if p.accept('(') {
+		return p.parseCall(name, start)
+	}
+
+	for i, variable := range p.variables {
+		if variable == name {
+			index := i
+			return func(v []float64) float64 { return v[index] }, nil
+		}
+	}
+
+	if value, ok := expressionConstants[name]; ok {
+		return func([]float64) float64 { return value }, nil
+	}
+
+	return nil, fmt.Errorf("unknown variable %q at position %d", name, start+1)
+}
+
+func (p *expressionParser) parseCall(name string, start int) (func([]float64) float64, error) {
+	function, ok := expressionFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name, start+1)
+	}
+
+	arguments := make([]func([]float64) float64, 0, 2)
+	if !p.accept(')') {
+		for {
+			argument, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			arguments = append(arguments, argument)
+
+			if p.accept(')') {
+				break
+			}
+			if !p.accept(',') {
+				return nil, fmt.Errorf("missing ')' at position %d", p.position+1)
+			}
+		}
+	}
+
+	switch f := function.(type) {
+	case func(float64) float64:
+		if len(arguments) != 1 {
+			return nil, fmt.Errorf("function %q takes 1 argument", name)
+		}
+		a := arguments[0]
+		return func(v []float64) float64 { return f(a(v)) }, nil
+
+	default:
+		g := function.(func(float64, float64) float64)
+		if len(arguments) != 2 {
+			return nil, fmt.Errorf("function %q takes 2 arguments", name)
+		}
+		a, b := arguments[0], arguments[1]
+		return func(v []float64) float64 { return g(a(v), b(v)) }, nil
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpressionEvaluate(t *testing.T) {
+	variables := []string{"x", "y"}
+	tests := []struct {
+		source string
+		x, y   float64
+		value  float64
+	}{
+		{"1 + 2 * 3", 0, 0, 7},
+		{"(1 + 2) * 3", 0, 0, 9},
+		{"10 - 4 - 3", 0, 0, 3},
+		{"12 / 3 / 2", 0, 0, 2},
+		{"7 % 4", 0, 0, 3},
+		{"2 ^ 3 ^ 2", 0, 0, 512},
+		{"-x ^ 2", 3, 0, -9},
+		{"(-x) ^ 2", 3, 0, 9},
+		{"2 ^ -1", 0, 0, 0.5},
+		{"--x", 3, 0, 3},
+		{"+x - -y", 3, 4, 7},
+		{"x * -y", 3, 4, -12},
+		{"1.5e-3 * 2", 0, 0, 0.003},
+		{".5 + 2E2", 0, 0, 200.5},
+		{"pi", 0, 0, math.Pi},
+		{"e", 0, 0, math.E},
+		{"sqrt(x * x + y * y)", 3, 4, 5},
+		{"max(x, y) - min(x, y)", 3, 4, 1},
+		{"pow(2, 10)", 0, 0, 1024},
+		{"atan2(y, x)", 1, 1, math.Pi / 4},
+		{"mod(x, 2)", 7, 0, 1},
+		{"abs(floor(-x)) + ceil(y)", 1.5, 0.2, 3},
+		{"exp(log(x))", 5, 0, 5},
+		{"  x\t+\ny  ", 1, 2, 3},
+	}
+
+	for _, test := range tests {
+		expression, err := ParseExpression(test.source, variables)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.source, err)
+			continue
+		}
+
+		value := expression.Evaluate(test.x, test.y)
+		if math.Abs(value-test.value) > 1e-12 {
+			t.Errorf("%q: got %v, want %v", test.source, value, test.value)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	variables := []string{"x"}
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"", "unexpected end of the expression"},
+		{"1 +", "unexpected end of the expression"},
+		{"(1 + 2", "missing ')' at position 7"},
+		{"1 + 2)", "unexpected ')' at position 6"},
+		{"1 2", "unexpected '2' at position 3"},
+		{"1 $ 2", "unexpected '$' at position 3"},
+		{"* 2", "unexpected '*' at position 1"},
+		{"1..2", "invalid number \"1..2\" at position 1"},
+		{"z + 1", "unknown variable \"z\" at position 1"},
+		{"foo(x)", "unknown function \"foo\" at position 1"},
+		{"sin(x, x)", "function \"sin\" takes 1 argument"},
+		{"sin()", "function \"sin\" takes 1 argument"},
+		{"max(x)", "function \"max\" takes 2 arguments"},
+		{"max(x x)", "missing ')' at position 7"},
+		{"x ^", "unexpected end of the expression"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseExpression(test.source, variables)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.source)
+			continue
+		}
+
+		if err.Error() != test.err {
+			t.Errorf("%q: got error %q, want %q", test.source, err.Error(), test.err)
+		}
+	}
+}
+
+func TestLoadConfigRadiusExpression(t *testing.T) {
+	route := t.TempDir() + "/"
+	err := CreateBaseConfig(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(expression string) {
+		config, err := LoadConfig(route)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.PegConfig.Distribution = ExpressionDist
+		config.PegConfig.Expression = expression
+		data, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(route+"config.json", data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("MinRadius + (MaxRadius - MinRadius) * row / (yMiddle + 1)")
+	_, err = LoadConfig(route)
+	if err != nil {
+		t.Errorf("valid expression: unexpected error %v", err)
+	}
+
+	write("MinRadius * (1 + x")
+	_, err = LoadConfig(route)
+	if err == nil || !strings.HasPrefix(err.Error(), "error parsing the radius expression") {
+		t.Errorf("malformed expression: got error %v", err)
+	}
+}
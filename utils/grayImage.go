@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"fmt"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+)
+
+// GrayImage represents the intensities of an image, between 0 (black) and 1 (white).
+type GrayImage struct {
+	Width  int
+	Height int
+	Values []float64
+}
+
+// LoadGrayImage reads a PNG file and converts it to grayscale.
+func LoadGrayImage(fileName string) (*GrayImage, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the radius image: %w", err)
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the radius image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	gray := &GrayImage{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Values: make([]float64, bounds.Dx()*bounds.Dy()),
+	}
+
+	for i := 0; i < gray.Height; i++ {
+		for j := 0; j < gray.Width; j++ {
+			pixel := color.Gray16Model.Convert(img.At(bounds.Min.X+j, bounds.Min.Y+i)).(color.Gray16)
+			gray.Values[i*gray.Width+j] = float64(pixel.Y) / math.MaxUint16
+		}
+	}
+
+	return gray, nil
+}
+
+// Sample returns the intensity at the relative position (u, v), both between 0 and
+// 1, with v growing downwards as the rows of the image.
+func (g *GrayImage) Sample(u, v float64, interpolation int) float64 {
+	x := math.Max(0, math.Min(u, 1)) * float64(g.Width-1)
+	y := math.Max(0, math.Min(v, 1)) * float64(g.Height-1)
+
+	if interpolation == InterpolationNearest {
+		return g.at(int(math.Round(x)), int(math.Round(y)))
+	}
+
+	x0 := int(math.Floor(x))
+	y0 := int(math.Floor(y))
+	fx := x - float64(x0)
+	fy := y - float64(y0)
+
+	top := g.at(x0, y0)*(1-fx) + g.at(x0+1, y0)*fx
+	bottom := g.at(x0, y0+1)*(1-fx) + g.at(x0+1, y0+1)*fx
+	return top*(1-fy) + bottom*fy
+}
+
+func (g *GrayImage) at(x, y int) float64 {
+	if x >= g.Width {
+		x = g.Width - 1
+	}
+	if y >= g.Height {
+		y = g.Height - 1
+	}
+
+	return g.Values[y*g.Width+x]
+}
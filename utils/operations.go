@@ -1,5 +1,9 @@
 package utils
 
+import (
+	"math"
+)
+
 type Point = [2]float64
 
 func Add(a, b *Point) *Point {
@@ -17,3 +21,32 @@ func Mul(a *Point, scalar float64) *Point {
 func DistanceSquare(a, b *Point) float64 {
 	return (a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1])
 }
+
+// SweptCircleImpact returns the fraction of the path from start to end at which a
+// moving circle first touches a static one, given the sum of both radii. Circles
+// that already overlap at the start are left to the discrete collision test.
+func SweptCircleImpact(start, end, center *Point, radius float64) (float64, bool) {
+	dx := end[0] - start[0]
+	dy := end[1] - start[1]
+	mx := start[0] - center[0]
+	my := start[1] - center[1]
+
+	a := dx*dx + dy*dy
+	b := 2 * (mx*dx + my*dy)
+	c := mx*mx + my*my - radius*radius
+	if a == 0 || c <= 0 {
+		return 0, false
+	}
+
+	discriminant := b*b - 4*a*c
+	if discriminant < 0 {
+		return 0, false
+	}
+
+	s := (-b - math.Sqrt(discriminant)) / (2 * a)
+	if s < 0 || s > 1 {
+		return 0, false
+	}
+
+	return s, true
+}
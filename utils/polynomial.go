@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"sort"
+)
+
+// Polynomial holds the coefficients of a polynomial, lowest degree first
+type Polynomial []float64
+
+// Evaluate returns the value of the polynomial at x
+func (p Polynomial) Evaluate(x float64) float64 {
+	value := 0.0
+	for i := len(p) - 1; i >= 0; i-- {
+		value = value*x + p[i]
+	}
+
+	return value
+}
+
+// Derivative returns the derivative of the polynomial
+func (p Polynomial) Derivative() Polynomial {
+	if len(p) <= 1 {
+		return Polynomial{}
+	}
+
+	derivative := make(Polynomial, len(p)-1)
+	for i := 1; i < len(p); i++ {
+		derivative[i-1] = float64(i) * p[i]
+	}
+
+	return derivative
+}
+
+func (p Polynomial) trim() Polynomial {
+	n := len(p)
+	for n > 0 && p[n-1] == 0 {
+		n--
+	}
+
+	return p[:n]
+}
+
+// Roots returns the real roots of the polynomial inside [lo, hi] in increasing order.
+// The interval is split at the roots of the derivative, so every piece is monotone
+// and holds at most one root, which is then found by bisection.
+func (p Polynomial) Roots(lo, hi float64) []float64 {
+	p = p.trim()
+	if len(p) <= 1 || lo > hi {
+		return nil
+	}
+
+	if len(p) == 2 {
+		root := -p[0] / p[1]
+		if root < lo || root > hi {
+			return nil
+		}
+		return []float64{root}
+	}
+
+	points := append([]float64{lo}, p.Derivative().Roots(lo, hi)...)
+	points = append(points, hi)
+	sort.Float64s(points)
+
+	var roots []float64
+	for i := 0; i+1 < len(points); i++ {
+		a, b := points[i], points[i+1]
+		fa, fb := p.Evaluate(a), p.Evaluate(b)
+
+		if fa == 0 {
+			if len(roots) == 0 || roots[len(roots)-1] != a {
+				roots = append(roots, a)
+			}
+			continue
+		}
+
+		if fa*fb < 0 {
+			roots = append(roots, p.bisect(a, b))
+		}
+	}
+
+	if p.Evaluate(hi) == 0 && (len(roots) == 0 || roots[len(roots)-1] != hi) {
+		roots = append(roots, hi)
+	}
+
+	return roots
+}
+
+// FirstEntry returns the first time in [lo, hi] at which the polynomial goes from
+// positive to non-positive. A polynomial that is already non-positive and still
+// decreasing at lo enters immediately.
+func (p Polynomial) FirstEntry(lo, hi float64) (float64, bool) {
+	p = p.trim()
+	if len(p) == 0 || lo > hi {
+		return 0, false
+	}
+
+	if p.Evaluate(lo) <= 0 && p.Derivative().Evaluate(lo) < 0 {
+		return lo, true
+	}
+
+	points := append([]float64{lo}, p.Derivative().Roots(lo, hi)...)
+	points = append(points, hi)
+	sort.Float64s(points)
+
+	for i := 0; i+1 < len(points); i++ {
+		a, b := points[i], points[i+1]
+		fb := p.Evaluate(b)
+		if p.Evaluate(a) > 0 && fb <= 0 {
+			// An exact zero is kept, bisection only finds a tangential root to sqrt(eps)
+			if fb == 0 {
+				return b, true
+			}
+			return p.bisect(a, b), true
+		}
+	}
+
+	return 0, false
+}
+
+// bisect finds the root of the polynomial in an interval where it changes sign,
+// returning the end of the final bracket on the side of the second point.
+func (p Polynomial) bisect(a, b float64) float64 {
+	fa := p.Evaluate(a)
+	for i := 0; i < 200; i++ {
+		middle := 0.5 * (a + b)
+		if middle == a || middle == b {
+			break
+		}
+
+		fm := p.Evaluate(middle)
+		if fm == 0 {
+			return middle
+		}
+
+		if (fm > 0) == (fa > 0) {
+			a, fa = middle, fm
+		} else {
+			b = middle
+		}
+	}
+
+	return b
+}
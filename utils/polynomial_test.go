@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+const polynomialTolerance = 1e-9
+
+func TestPolynomialRoots(t *testing.T) {
+	tests := []struct {
+		name       string
+		polynomial Polynomial
+		lo, hi     float64
+		roots      []float64
+	}{
+		{"linear", Polynomial{-1, 2}, 0, 1, []float64{0.5}},
+		{"linear outside", Polynomial{-1, 2}, 1, 2, nil},
+		{"two simple roots", Polynomial{3, -4, 1}, 0, 5, []float64{1, 3}},
+		{"double root", Polynomial{4, -4, 1}, 0, 5, []float64{2}},
+		{"triple root", Polynomial{-1, 3, -3, 1}, 0, 5, []float64{1}},
+		{"root at lo", Polynomial{-1, 0, 1}, 1, 3, []float64{1}},
+		{"root at hi", Polynomial{-1, 0, 1}, -3, -1, []float64{-1}},
+		{"roots at both ends", Polynomial{-1, 0, 1}, -1, 1, []float64{-1, 1}},
+		{"double root at hi", Polynomial{4, -4, 1}, 0, 2, []float64{2}},
+		{"no real root", Polynomial{1, 0, 1}, -5, 5, nil},
+		{"trailing zeros", Polynomial{3, -4, 1, 0, 0}, 0, 5, []float64{1, 3}},
+		{"constant", Polynomial{2}, 0, 1, nil},
+		{"empty interval", Polynomial{3, -4, 1}, 5, 0, nil},
+		{"quartic", Polynomial{4, 0, -5, 0, 1}, -3, 3, []float64{-2, -1, 1, 2}},
+	}
+
+	for _, test := range tests {
+		roots := test.polynomial.Roots(test.lo, test.hi)
+		if len(roots) != len(test.roots) {
+			t.Errorf("%s: got roots %v, want %v", test.name, roots, test.roots)
+			continue
+		}
+
+		for i := range roots {
+			if math.Abs(roots[i]-test.roots[i]) > polynomialTolerance {
+				t.Errorf("%s: got roots %v, want %v", test.name, roots, test.roots)
+				break
+			}
+		}
+	}
+}
+
+func TestPolynomialFirstEntry(t *testing.T) {
+	tests := []struct {
+		name       string
+		polynomial Polynomial
+		lo, hi     float64
+		entry      float64
+		ok         bool
+	}{
+		{"simple root", Polynomial{3, -4, 1}, 0, 5, 1, true},
+		{"entry at hi", Polynomial{3, -4, 1}, 0, 1, 1, true},
+		{"entry after the interval", Polynomial{3, -4, 1}, 0, 0.5, 0, false},
+		{"tangential touch", Polynomial{4, -4, 1}, 0, 5, 2, true},
+		{"inside and approaching", Polynomial{-1, -1}, 0, 5, 0, true},
+		{"inside and leaving", Polynomial{-1, 1}, 0, 5, 0, false},
+		{"on the surface and leaving", Polynomial{0, 1}, 0, 5, 0, false},
+		{"on the surface and approaching", Polynomial{0, -1}, 0, 5, 0, true},
+		{"leaves and enters again", Polynomial{-3, 4, -1}, 0, 5, 3, true},
+		{"never enters", Polynomial{1, 0, 1}, -5, 5, 0, false},
+		{"empty interval", Polynomial{3, -4, 1}, 5, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		entry, ok := test.polynomial.FirstEntry(test.lo, test.hi)
+		if ok != test.ok || (ok && math.Abs(entry-test.entry) > polynomialTolerance) {
+			t.Errorf("%s: got (%v, %v), want (%v, %v)", test.name, entry, ok, test.entry, test.ok)
+		}
+	}
+}
+
+func TestPolynomialEvaluate(t *testing.T) {
+	p := Polynomial{1, -2, 3}
+	if value := p.Evaluate(2); value != 9 {
+		t.Errorf("got %v, want 9", value)
+	}
+
+	derivative := p.Derivative()
+	if len(derivative) != 2 || derivative[0] != -2 || derivative[1] != 6 {
+		t.Errorf("got derivative %v, want [-2 6]", derivative)
+	}
+}
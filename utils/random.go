@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+)
+
+// Random is a seeded random number generator owned by a single simulation
+type Random struct {
+	*rand.Rand
+	source *rand.PCG
+}
+
+// NewRandom returns a new generator seeded with the given value
+func NewRandom(seed uint64) *Random {
+	source := rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)
+	return &Random{
+		Rand:   rand.New(source),
+		source: source,
+	}
+}
+
+// Split returns a new independent generator seeded from this one
+func (r *Random) Split() *Random {
+	return NewRandom(r.Uint64())
+}
+
+// NewSeed returns a fresh non-zero seed for runs without a configured one
+func NewSeed() uint64 {
+	seed := rand.Uint64()
+	for seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	return seed
+}
+
+// MarshalJSON encodes the current state of the generator
+func (r *Random) MarshalJSON() ([]byte, error) {
+	state, err := r.source.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON restores a generator state written by MarshalJSON
+func (r *Random) UnmarshalJSON(data []byte) error {
+	var state []byte
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	source := &rand.PCG{}
+	err = source.UnmarshalBinary(state)
+	if err != nil {
+		return err
+	}
+
+	r.source = source
+	r.Rand = rand.New(source)
+	return nil
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schedule represents a piecewise-linear displacement, given at increasing times.
+type Schedule struct {
+	Times []float64
+	X     []float64
+	Y     []float64
+}
+
+// LoadSchedule reads a CSV file with one t, dx, dy point per line. Comments and a
+// header line are skipped.
+func LoadSchedule(fileName string) (*Schedule, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.New("error opening the schedule file")
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	schedule := &Schedule{}
+	for line := 0; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(fields) != 3 {
+			return nil, errors.New("the schedule file needs 3 columns at line " + strconv.Itoa(line+1))
+		}
+
+		values := make([]float64, 3)
+		for i, field := range fields {
+			values[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			if line == 0 {
+				continue
+			}
+			return nil, errors.New("invalid number in the schedule file at line " + strconv.Itoa(line+1))
+		}
+
+		if len(schedule.Times) > 0 && values[0] <= schedule.Times[len(schedule.Times)-1] {
+			return nil, errors.New("the times of the schedule file must increase, at line " + strconv.Itoa(line+1))
+		}
+
+		schedule.Times = append(schedule.Times, values[0])
+		schedule.X = append(schedule.X, values[1])
+		schedule.Y = append(schedule.Y, values[2])
+	}
+
+	if len(schedule.Times) == 0 {
+		return nil, errors.New("the schedule file has no points")
+	}
+
+	return schedule, nil
+}
+
+// At returns the displacement at the given time. Outside the schedule it holds the
+// closest point, unless loop repeats the schedule over its duration.
+func (s *Schedule) At(t float64, loop bool) (float64, float64) {
+	n := len(s.Times)
+	duration := s.Times[n-1] - s.Times[0]
+	if loop && duration > 0 {
+		t = s.Times[0] + math.Mod(t-s.Times[0], duration)
+		if t < s.Times[0] {
+			t += duration
+		}
+	}
+
+	if t <= s.Times[0] {
+		return s.X[0], s.Y[0]
+	}
+	if t >= s.Times[n-1] {
+		return s.X[n-1], s.Y[n-1]
+	}
+
+	i := sort.SearchFloat64s(s.Times, t)
+	f := (t - s.Times[i-1]) / (s.Times[i] - s.Times[i-1])
+	return s.X[i-1] + f*(s.X[i]-s.X[i-1]), s.Y[i-1] + f*(s.Y[i]-s.Y[i-1])
+}